@@ -14,22 +14,75 @@ import (
 
 // Message sent by Agent to Neptune.io service to report runbook execution results.
 type ActionOutputMessage struct {
-	RuleName         string `json:"ruleName"`
-	RuleId           string `json:"ruleId"`
-	AgentId          string `json:"agentId"`
-	EventId          string `json:"eventId"`
-	Status           string `json:"status"`
-	ActionOutput     string `json:"actionOutput"`
-	FailureReason    string `json:"failureReason"`
-	StatusCode       int    `json:"statusCode"`
-	InflightActionId string `json:"inflightActionId"`
-	IsTimeout        bool   `json:"isTimeout"`
-	HostName         string `json:"hostName"`
-	ActionType       string `json:"actionType"`
+	RuleName      string `json:"ruleName"`
+	RuleId        string `json:"ruleId"`
+	AgentId       string `json:"agentId"`
+	EventId       string `json:"eventId"`
+	Status        string `json:"status"`
+	ActionOutput  string `json:"actionOutput"`
+	FailureReason string `json:"failureReason"`
+
+	// Encoding is "base64" if the output was binary. Sizes are the byte counts before truncation.
+	ActionOutputEncoding   string `json:"actionOutputEncoding,omitempty"`
+	ActionOutputSize       int    `json:"actionOutputSize"`
+	ActionOutputTruncated  bool   `json:"actionOutputTruncated"`
+	FailureReasonEncoding  string `json:"failureReasonEncoding,omitempty"`
+	FailureReasonSize      int    `json:"failureReasonSize"`
+	FailureReasonTruncated bool   `json:"failureReasonTruncated"`
+
+	// Optional combined stdout and stderr lines tagged with their stream and time offset.
+	Transcript          string `json:"transcript,omitempty"`
+	TranscriptEncoding  string `json:"transcriptEncoding,omitempty"`
+	TranscriptTruncated bool   `json:"transcriptTruncated,omitempty"`
+
+	StatusCode       int           `json:"statusCode"`
+	InflightActionId string        `json:"inflightActionId"`
+	IsTimeout        bool          `json:"isTimeout"`
+	HostName         string        `json:"hostName"`
+	ActionType       string        `json:"actionType"`
+	Result           *ActionResult `json:"result,omitempty"`
+	ResultError      string        `json:"resultError,omitempty"`
+	Steps            []StepResult  `json:"steps,omitempty"`
+	Rollback         *StepResult   `json:"rollback,omitempty"`
+	Checks           []CheckResult `json:"checks,omitempty"`
+	LockWaitMs       int64         `json:"lockWaitMs"`
+
+	// Artifacts left by the runbook. If some are still being uploaded, ArtifactsPending is set and their
+	// results follow in an ArtifactsMessage.
+	Artifacts        []ArtifactInfo `json:"artifacts,omitempty"`
+	ArtifactsPending bool           `json:"artifactsPending,omitempty"`
+
+	// Attempt number of the execution, starting at 1. WillRetry is set if another attempt follows.
+	Attempt   int  `json:"attempt"`
+	WillRetry bool `json:"willRetry"`
+
+	// Context of the span of the event, under which reporting the output is traced.
+	trace *spanContext
+}
+
+// Function to mask the secrets in the results before they leave the agent. The runbook outputs were
+// already redacted when they were encoded.
+func (m *ActionOutputMessage) redact() {
+	for i := range m.Checks {
+		m.Checks[i].Message = logging.Redact(m.Checks[i].Message)
+	}
+	m.ResultError = logging.Redact(m.ResultError)
+	if m.Result != nil {
+		m.Result.redact()
+	}
 }
 
 // Function to upload runbook execution results to Neptune.io service.
-func SendActionOutput(configObj *NeptuneConfig, request *ActionOutputMessage) error {
+func SendActionOutput(configObj *NeptuneConfig, request *ActionOutputMessage) (err error) {
+	span := startSpan("SendActionOutput", spanKindClient, request.trace)
+	span.setAttribute("neptune.event_id", request.EventId)
+	span.setAttribute("neptune.status", request.Status)
+	defer func() {
+		span.setError(err)
+		span.finish()
+	}()
+
+	request.redact()
 
 	logging.Debug("Sending action output to Neptune.", logging.Fields{"request": *request})
 	response := Response{}
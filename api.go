@@ -4,8 +4,12 @@
 package agent
 
 import (
+	"encoding/json"
+	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/neptuneio/agent/logging"
 )
 
 // Agent status type definition.
@@ -47,8 +51,37 @@ type Event struct {
 	Timeout          int32             `json:"timeout"`
 	GithubFilePath   string            `json:"githubFilePath"`
 	Environment      map[string]string `json:"env"`
+	Secrets          map[string]string `json:"secrets"`
+	Retry            *RetryPolicy      `json:"retry"`
+	Rollback         *RunbookRef       `json:"rollback"`
+	PreChecks        []HealthCheck     `json:"preChecks"`
+	PostChecks       []HealthCheck     `json:"postChecks"`
+	Locks            []LockSpec        `json:"locks"`
+	Params           json.RawMessage   `json:"params"`
 	SQSMessageId     string
 	ReceiptHandle    string
+
+	// Set for the synthetic events created by the agent itself, which never come from SQS.
+	local bool
+
+	// Context of the span tracing the handling of the event, if tracing is enabled.
+	trace *spanContext
+}
+
+// Function to return a copy of the event which is safe to log. Environment values might carry
+// credentials so only their names are kept.
+func (e Event) loggable() Event {
+	if e.Environment != nil {
+		env := make(map[string]string, len(e.Environment))
+		for k := range e.Environment {
+			env[k] = logging.RedactedText
+		}
+		e.Environment = env
+	}
+	if len(e.Params) > 0 {
+		e.Params = json.RawMessage(strconv.Quote(logging.RedactedText))
+	}
+	return e
 }
 
 // Function to return string representation of Status.
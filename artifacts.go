@@ -0,0 +1,392 @@
+// Package artifacts is responsible for collecting the files which runbooks leave in their artifacts
+// directory, like heap dumps or packet captures, and uploading them to Neptune.io. Artifacts are
+// compressed and uploaded either through a pre-signed URL handed out by Neptune.io or to a
+// multipart upload endpoint configured on the agent. Uploads happen in the background once the
+// action output is sent, and their results are reported to Neptune.io in a follow-up message.
+package agent
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+const (
+	// Environment variable holding the directory in which the runbook can leave its artifacts.
+	artifactsDirEnvVar = "NEPTUNE_ARTIFACTS_DIR"
+	artifactsDirName   = "artifacts"
+
+	// Default quotas on the artifacts of a single execution.
+	defaultMaxArtifactFiles       = 20
+	defaultMaxArtifactFileSizeMB  = 100
+	defaultMaxArtifactTotalSizeMB = 200
+
+	// Artifacts are uploaded in parallel, and all the uploads of an execution must finish in time.
+	maxParallelArtifactUploads = 4
+	artifactUploadTimeout      = 10 * time.Minute
+)
+
+// Metadata of an artifact left by the runbook, reported along with the action output.
+type ArtifactInfo struct {
+	Name           string `json:"name"`
+	Size           int64  `json:"size"`
+	SHA256         string `json:"sha256"`
+	CompressedSize int64  `json:"compressedSize,omitempty"`
+	Uploaded       bool   `json:"uploaded"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Message sent by Agent to Neptune.io service to get a pre-signed URL for uploading an artifact.
+type ArtifactUploadRequest struct {
+	AgentId          string
+	EventId          string
+	InflightActionId string
+	Name             string
+	Size             int64
+	CompressedSize   int64
+	SHA256           string
+}
+
+// Message received from Neptune.io service with the pre-signed URL to upload an artifact to.
+type ArtifactUploadResponse struct {
+	UploadURL string
+}
+
+// Message sent by Agent to Neptune.io service once the artifacts of an execution attempt are uploaded.
+type ArtifactsMessage struct {
+	AgentId          string         `json:"agentId"`
+	EventId          string         `json:"eventId"`
+	InflightActionId string         `json:"inflightActionId"`
+	Attempt          int            `json:"attempt"`
+	Artifacts        []ArtifactInfo `json:"artifacts"`
+}
+
+// Global variable to hold the artifact quotas and upload settings.
+var artifactsConfig = ArtifactsConfig{
+	MaxFiles:       defaultMaxArtifactFiles,
+	MaxFileSizeMB:  defaultMaxArtifactFileSizeMB,
+	MaxTotalSizeMB: defaultMaxArtifactTotalSizeMB,
+}
+
+// Function to initialize the artifact quotas and upload settings from agent config.
+func InitializeArtifacts(config ArtifactsConfig) {
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = defaultMaxArtifactFiles
+	}
+	if config.MaxFileSizeMB <= 0 {
+		config.MaxFileSizeMB = defaultMaxArtifactFileSizeMB
+	}
+	if config.MaxTotalSizeMB <= 0 {
+		config.MaxTotalSizeMB = defaultMaxArtifactTotalSizeMB
+	}
+	artifactsConfig = config
+}
+
+// Function to create the artifacts directory for the given attempt of the event. Every attempt has its
+// own directory since the artifacts of an attempt may still be uploading when the next one starts.
+func createArtifactsDir(eventId string, attempt int) (string, error) {
+	dir := filepath.Join(workingDir, artifactsDirName, eventId, strconv.Itoa(attempt))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logging.Error("Could not create artifacts directory.", logging.Fields{"error": err, "dir": dir})
+		return "", err
+	}
+	return dir, nil
+}
+
+// Function to list the artifacts in the given directory, enforcing the quotas. Returns the metadata of
+// every artifact found and the paths of the ones within the quotas by their index.
+func collectArtifacts(dir string) ([]ArtifactInfo, map[int]string) {
+	var paths []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	maxFileSize := int64(artifactsConfig.MaxFileSizeMB) * 1024 * 1024
+	maxTotalSize := int64(artifactsConfig.MaxTotalSizeMB) * 1024 * 1024
+
+	artifacts := make([]ArtifactInfo, len(paths))
+	accepted := map[int]string{}
+	var totalSize int64
+	for i, path := range paths {
+		name, _ := filepath.Rel(dir, path)
+		artifact := &artifacts[i]
+		artifact.Name = filepath.ToSlash(name)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			artifact.Error = err.Error()
+			continue
+		}
+		artifact.Size = info.Size()
+
+		switch {
+		case len(accepted) >= artifactsConfig.MaxFiles:
+			artifact.Error = fmt.Sprintf("Exceeds the quota of %d artifacts.", artifactsConfig.MaxFiles)
+		case artifact.Size > maxFileSize:
+			artifact.Error = fmt.Sprintf("Exceeds the quota of %dMB per artifact.", artifactsConfig.MaxFileSizeMB)
+		case totalSize+artifact.Size > maxTotalSize:
+			artifact.Error = fmt.Sprintf("Exceeds the quota of %dMB for all artifacts.", artifactsConfig.MaxTotalSizeMB)
+		default:
+			totalSize += artifact.Size
+			accepted[i] = path
+		}
+	}
+	return artifacts, accepted
+}
+
+// Function to compress and upload the accepted artifacts of an execution attempt, and to report them to
+// Neptune.io once done. This runs in the background so that neither the action output nor the locks of
+// the runbook wait for the uploads. The artifacts are uploaded in parallel and the uploads not done
+// within the upload timeout are given up. The directory is removed afterwards.
+func uploadArtifacts(regInfo *RegistrationInfo, event *Event, attempt int, dir string, artifacts []ArtifactInfo, accepted map[int]string) {
+	defer removeArtifactsDir(dir)
+	if len(accepted) == 0 {
+		return
+	}
+
+	// Every upload writes the metadata of its own artifact only.
+	deadline := time.Now().Add(artifactUploadTimeout)
+	slots := make(chan struct{}, maxParallelArtifactUploads)
+	var wg sync.WaitGroup
+	for i, path := range accepted {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(path string, artifact *ArtifactInfo) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := uploadArtifact(regInfo, event, path, artifact, deadline); err != nil {
+				logging.Error("Could not upload the artifact.", logging.Fields{"error": err, "artifact": artifact.Name, "eventId": event.EventId})
+				artifact.Error = err.Error()
+			} else {
+				artifact.Uploaded = true
+			}
+		}(path, &artifacts[i])
+	}
+	wg.Wait()
+
+	if err := sendArtifacts(&ArtifactsMessage{
+		AgentId:          regInfo.AgentId,
+		EventId:          event.EventId,
+		InflightActionId: event.InflightActionId,
+		Attempt:          attempt,
+		Artifacts:        artifacts,
+	}); err != nil {
+		logging.Warn("Could not report the uploaded artifacts.", logging.Fields{"error": err, "eventId": event.EventId})
+	}
+}
+
+// Function to remove the artifacts directory of an attempt, and the directory of the event once all
+// its attempts are done.
+func removeArtifactsDir(dir string) {
+	os.RemoveAll(dir)
+	os.Remove(filepath.Dir(dir))
+}
+
+// Function to report the artifacts of an execution attempt to Neptune.io service.
+func sendArtifacts(message *ArtifactsMessage) error {
+	if neptuneConfig == nil {
+		return errors.New("Neptune.io config is not set.")
+	}
+
+	response := Response{}
+	resp, err := napping.Post(joinURL(neptuneConfig.Endpoint, "action_artifacts", neptuneConfig.ApiKey), message, &response, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Status() < 200 || resp.Status() > 299 {
+		return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+	}
+	return nil
+}
+
+// Function to compress a single artifact into a temp file and upload it before the deadline.
+func uploadArtifact(regInfo *RegistrationInfo, event *Event, path string, artifact *ArtifactInfo, deadline time.Time) error {
+	if !time.Now().Before(deadline) {
+		return errors.New("Upload timed out before it could start.")
+	}
+	compressed, err := compressArtifact(path, artifact)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(compressed)
+
+	if len(artifactsConfig.UploadEndpoint) > 0 {
+		return uploadArtifactMultipart(regInfo, event, compressed, artifact, deadline)
+	}
+	return uploadArtifactPresigned(regInfo, event, compressed, artifact, deadline)
+}
+
+// Function to gzip the artifact while computing its checksum and sizes.
+func compressArtifact(path string, artifact *ArtifactInfo) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(workingDir, "artifact")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	gz := gzip.NewWriter(out)
+	size, err := io.Copy(io.MultiWriter(gz, hash), in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	artifact.Size = size
+	artifact.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	artifact.CompressedSize = info.Size()
+	return out.Name(), nil
+}
+
+// Function to upload the compressed artifact to a pre-signed URL handed out by Neptune.io.
+func uploadArtifactPresigned(regInfo *RegistrationInfo, event *Event, compressed string, artifact *ArtifactInfo, deadline time.Time) error {
+	if neptuneConfig == nil {
+		return errors.New("Neptune.io config is not set.")
+	}
+
+	request := ArtifactUploadRequest{
+		AgentId:          regInfo.AgentId,
+		EventId:          event.EventId,
+		InflightActionId: event.InflightActionId,
+		Name:             artifact.Name,
+		Size:             artifact.Size,
+		CompressedSize:   artifact.CompressedSize,
+		SHA256:           artifact.SHA256,
+	}
+	response := ArtifactUploadResponse{}
+	resp, err := napping.Post(joinURL(neptuneConfig.Endpoint, "artifact_upload_url", neptuneConfig.ApiKey), &request, &response, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Status() < 200 || resp.Status() > 299 {
+		return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+	}
+	if len(response.UploadURL) == 0 {
+		return errors.New("Server did not return an upload URL.")
+	}
+
+	f, err := os.Open(compressed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest("PUT", response.UploadURL, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = artifact.CompressedSize
+	req.Header.Set("Content-Type", "application/gzip")
+
+	return doArtifactUpload(req, deadline)
+}
+
+// Function to upload the compressed artifact to the configured multipart upload endpoint. The endpoint
+// has its own upload token since it needn't be a Neptune.io host, so the API key is never sent to it.
+func uploadArtifactMultipart(regInfo *RegistrationInfo, event *Event, compressed string, artifact *ArtifactInfo, deadline time.Time) error {
+	f, err := os.Open(compressed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Stream the multipart body so that large artifacts are not held in memory.
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		fields := map[string]string{
+			"agentId":          regInfo.AgentId,
+			"eventId":          event.EventId,
+			"inflightActionId": event.InflightActionId,
+			"name":             artifact.Name,
+			"size":             strconv.FormatInt(artifact.Size, 10),
+			"sha256":           artifact.SHA256,
+		}
+		for k, v := range fields {
+			if err := writer.WriteField(k, v); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := writer.CreateFormFile("file", artifact.Name+".gz")
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", joinURL(artifactsConfig.UploadEndpoint, "artifacts"), pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if len(artifactsConfig.UploadToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+artifactsConfig.UploadToken)
+	}
+
+	return doArtifactUpload(req, deadline)
+}
+
+func doArtifactUpload(req *http.Request, deadline time.Time) error {
+	// A zero timeout would mean no timeout at all.
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return errors.New("Upload timed out before it could start.")
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Upload returned unexpected status: " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Package util contains the utility code used in Neptune.io agent.
+package agent
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const tmpFileSuffix = ".tmp"
+
+// Function to replace the file at given path with the content written by the given function, without
+// ever leaving a partially written file behind. The content is written to a temp file which is synced
+// and then renamed over the original file, so a crash at any point leaves either the old or the new file.
+func replaceFile(path string, write func(f *os.File) error) error {
+	tmpPath := path + tmpFileSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Function to sync a directory so that a rename in it is durable. Not all platforms support this so
+// errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
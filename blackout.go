@@ -0,0 +1,187 @@
+// Package blackout is responsible for the maintenance windows during which the agent doesn't run any
+// runbook, like during deploys or incidents. Windows are either one-off time ranges or recurring cron
+// schedules from the agent config, or a manual blackout toggled from the command line. Events received
+// during a blackout are either deferred by releasing them back to the queue or rejected.
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	blackoutStateFile = ".blackout"
+	blackoutStatus    = "BLACKOUT"
+
+	// Policies for the events received during a blackout.
+	blackoutPolicyDefer  = "defer"
+	blackoutPolicyReject = "reject"
+
+	manualBlackoutSource = "manual"
+
+	// Deferred events become visible again after the blackout ends, but at least this often so that
+	// a blackout ended from the command line takes effect soon.
+	maxBlackoutDeferDelay = 5 * time.Minute
+)
+
+// Blackout window from the agent config.
+type blackoutWindow struct {
+	name     string
+	start    time.Time
+	end      time.Time
+	cron     *cronSchedule
+	duration time.Duration
+}
+
+// Manual blackout toggled from the command line. Until is zero if the blackout lasts until it's turned off.
+type ManualBlackout struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	Since   int64  `json:"since"`
+	Until   int64  `json:"until,omitempty"`
+}
+
+// Current blackout state of the agent, reported in heartbeats. Until is zero if the end isn't known.
+type BlackoutStatus struct {
+	Active bool   `json:"active"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+	Policy string `json:"policy"`
+}
+
+// Global variables to hold the blackout settings.
+var blackoutWindows []blackoutWindow
+var blackoutPolicy = blackoutPolicyDefer
+var blackoutStatePath string
+
+// Function to initialize the blackout windows from agent config. The manual blackout state is kept in
+// the given directory. Invalid windows are ignored.
+func InitializeBlackout(config BlackoutConfig, dir string) {
+	blackoutStatePath = filepath.Join(dir, blackoutStateFile)
+	blackoutPolicy = blackoutPolicyDefer
+	if config.Policy == blackoutPolicyReject {
+		blackoutPolicy = blackoutPolicyReject
+	}
+
+	windows := []blackoutWindow{}
+	for _, w := range config.Windows {
+		window := blackoutWindow{name: w.Name, duration: time.Duration(w.DurationMinutes) * time.Minute}
+		if len(w.Cron) > 0 {
+			schedule, err := parseCron(w.Cron)
+			if err != nil || window.duration <= 0 {
+				logging.Warn("Ignoring invalid recurring blackout window.", logging.Fields{"window": w.Name, "error": err})
+				continue
+			}
+			window.cron = schedule
+		} else {
+			start, err1 := time.Parse(time.RFC3339, w.Start)
+			end, err2 := time.Parse(time.RFC3339, w.End)
+			if err1 != nil || err2 != nil || !start.Before(end) {
+				logging.Warn("Ignoring invalid blackout window.", logging.Fields{"window": w.Name, "start": w.Start, "end": w.End})
+				continue
+			}
+			window.start, window.end = start, end
+		}
+		windows = append(windows, window)
+	}
+
+	blackoutWindows = windows
+	logging.Info("Initialized blackout windows.", logging.Fields{"count": len(windows), "policy": blackoutPolicy})
+}
+
+// Function to check if the window covers the given time. Returns the end of the window if so.
+func (w *blackoutWindow) activeAt(t time.Time) (time.Time, bool) {
+	if w.cron == nil {
+		return w.end, !t.Before(w.start) && t.Before(w.end)
+	}
+
+	// Look for the latest start of the window within its duration before the given time.
+	minute := t.Truncate(time.Minute)
+	for m := minute; t.Sub(m) < w.duration; m = m.Add(-time.Minute) {
+		if w.cron.matches(m) {
+			return m.Add(w.duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Function to get the current blackout state. A manual blackout takes precedence over the windows.
+func CurrentBlackout() BlackoutStatus {
+	now := time.Now()
+	status := BlackoutStatus{Policy: blackoutPolicy}
+
+	if manual, err := readManualBlackout(); err != nil {
+		logging.Warn("Could not read the manual blackout state.", logging.Fields{"error": err, "file": blackoutStatePath})
+	} else if manual.Enabled && (manual.Until == 0 || now.UnixNano()/1000000 < manual.Until) {
+		status.Active = true
+		status.Source = manualBlackoutSource
+		status.Reason = manual.Reason
+		status.Until = manual.Until
+		return status
+	}
+
+	for _, w := range blackoutWindows {
+		if end, ok := w.activeAt(now); ok {
+			status.Active = true
+			status.Source = w.name
+			status.Until = end.UnixNano() / 1000000
+			return status
+		}
+	}
+	return status
+}
+
+func readManualBlackout() (ManualBlackout, error) {
+	manual := ManualBlackout{}
+	if len(blackoutStatePath) == 0 {
+		return manual, nil
+	}
+
+	data, err := ioutil.ReadFile(blackoutStatePath)
+	if os.IsNotExist(err) {
+		return manual, nil
+	} else if err != nil {
+		return manual, err
+	}
+	err = json.Unmarshal(data, &manual)
+	return manual, err
+}
+
+// Function to turn the manual blackout on or off. A positive duration ends the blackout automatically.
+// The running agent picks up the change when it handles the next event.
+func SetManualBlackout(dir string, enabled bool, reason string, duration time.Duration) error {
+	manual := ManualBlackout{Enabled: enabled, Reason: reason, Since: time.Now().UnixNano() / 1000000}
+	if enabled && duration > 0 {
+		manual.Until = time.Now().Add(duration).UnixNano() / 1000000
+	}
+
+	data, err := json.Marshal(manual)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(dir, blackoutStateFile), func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// Function to get the delay after which an event deferred by the given blackout is retried.
+func blackoutDeferDelay(status BlackoutStatus) time.Duration {
+	if status.Until == 0 {
+		return maxBlackoutDeferDelay
+	}
+
+	delay := time.Unix(0, status.Until*int64(time.Millisecond)).Sub(time.Now())
+	if delay > maxBlackoutDeferDelay {
+		return maxBlackoutDeferDelay
+	} else if delay < 0 {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test the membership of one-off and recurring windows, and the end reported for them.
+func TestBlackoutWindowActiveAt(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	nightly, err := parseCron("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneOff := blackoutWindow{name: "release", start: at(15, 10, 0), end: at(15, 12, 0)}
+	recurring := blackoutWindow{name: "backups", cron: nightly, duration: 90 * time.Minute}
+
+	tests := []struct {
+		name       string
+		window     blackoutWindow
+		t          time.Time
+		wantActive bool
+		wantEnd    time.Time
+	}{
+		{name: "before a one-off window", window: oneOff, t: at(15, 9, 59)},
+		{name: "at the start of a one-off window", window: oneOff, t: at(15, 10, 0), wantActive: true, wantEnd: at(15, 12, 0)},
+		{name: "within a one-off window", window: oneOff, t: at(15, 11, 30), wantActive: true, wantEnd: at(15, 12, 0)},
+		{name: "at the end of a one-off window", window: oneOff, t: at(15, 12, 0)},
+		{name: "before a recurring window", window: recurring, t: at(15, 1, 59)},
+		{name: "at the start of a recurring window", window: recurring, t: at(15, 2, 0), wantActive: true, wantEnd: at(15, 3, 30)},
+		{name: "within a recurring window", window: recurring, t: at(16, 3, 29).Add(30 * time.Second), wantActive: true, wantEnd: at(16, 3, 30)},
+		{name: "at the end of a recurring window", window: recurring, t: at(15, 3, 30)},
+	}
+
+	for _, test := range tests {
+		end, active := test.window.activeAt(test.t)
+		if active != test.wantActive || (active && !end.Equal(test.wantEnd)) {
+			t.Errorf("%s: activeAt() = %v, %v, want %v, %v", test.name, end, active, test.wantEnd, test.wantActive)
+		}
+	}
+}
+
+// Test that invalid windows are ignored and that the manual blackout takes precedence over the windows.
+func TestCurrentBlackout(t *testing.T) {
+	dir := useTestBlackout(t, BlackoutConfig{Policy: blackoutPolicyReject, Windows: []BlackoutWindowConfig{
+		{Name: "invalid cron", Cron: "61 * * * *", DurationMinutes: 10},
+		{Name: "no duration", Cron: "* * * * *"},
+		{Name: "end before start", Start: "2024-01-15T12:00:00Z", End: "2024-01-15T10:00:00Z"},
+		{Name: "always", Cron: "* * * * *", DurationMinutes: 10},
+	}})
+
+	if len(blackoutWindows) != 1 {
+		t.Fatalf("%d windows are kept, want only the valid one", len(blackoutWindows))
+	}
+	status := CurrentBlackout()
+	if !status.Active || status.Source != "always" || status.Policy != blackoutPolicyReject || status.Until == 0 {
+		t.Errorf("CurrentBlackout() = %+v, want the always window", status)
+	}
+
+	if err := SetManualBlackout(dir, true, "maintenance", time.Hour); err != nil {
+		t.Fatalf("SetManualBlackout() failed: %v", err)
+	}
+	if status := CurrentBlackout(); status.Source != manualBlackoutSource || status.Reason != "maintenance" {
+		t.Errorf("CurrentBlackout() = %+v, want the manual blackout", status)
+	}
+
+	if err := SetManualBlackout(dir, false, "", 0); err != nil {
+		t.Fatalf("SetManualBlackout() failed: %v", err)
+	}
+	if status := CurrentBlackout(); status.Source != "always" {
+		t.Errorf("CurrentBlackout() = %+v after the manual blackout ended, want the always window", status)
+	}
+}
+
+// Test that an expired manual blackout is over.
+func TestExpiredManualBlackout(t *testing.T) {
+	dir := useTestBlackout(t, BlackoutConfig{})
+	if err := SetManualBlackout(dir, true, "", time.Millisecond); err != nil {
+		t.Fatalf("SetManualBlackout() failed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if status := CurrentBlackout(); status.Active || status.Policy != blackoutPolicyDefer {
+		t.Errorf("CurrentBlackout() = %+v, want no blackout with the defer policy", status)
+	}
+}
+
+// Test that deferred events are retried at the end of the blackout, but at least every few minutes.
+func TestBlackoutDeferDelay(t *testing.T) {
+	inMillis := func(d time.Duration) int64 {
+		return time.Now().Add(d).UnixNano() / 1000000
+	}
+
+	tests := []struct {
+		name    string
+		until   int64
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "unknown end", until: 0, wantMin: maxBlackoutDeferDelay, wantMax: maxBlackoutDeferDelay},
+		{name: "ends soon", until: inMillis(time.Minute), wantMin: 59 * time.Second, wantMax: time.Minute},
+		{name: "ends late", until: inMillis(time.Hour), wantMin: maxBlackoutDeferDelay, wantMax: maxBlackoutDeferDelay},
+		{name: "already ended", until: inMillis(-time.Minute), wantMin: 0, wantMax: 0},
+	}
+
+	for _, test := range tests {
+		got := blackoutDeferDelay(BlackoutStatus{Active: true, Until: test.until})
+		if got < test.wantMin || got > test.wantMax {
+			t.Errorf("%s: blackoutDeferDelay() = %v, want between %v and %v", test.name, got, test.wantMin, test.wantMax)
+		}
+	}
+}
+
+// Function to run a test with the given blackout settings and the manual blackout kept in a temp directory.
+func useTestBlackout(t *testing.T, config BlackoutConfig) string {
+	dir, err := ioutil.TempDir("", "blackout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldWindows, oldPolicy, oldPath := blackoutWindows, blackoutPolicy, blackoutStatePath
+	t.Cleanup(func() {
+		blackoutWindows, blackoutPolicy, blackoutStatePath = oldWindows, oldPolicy, oldPath
+		os.RemoveAll(dir)
+	})
+
+	InitializeBlackout(config, dir)
+	return dir
+}
@@ -0,0 +1,241 @@
+// Package breaker is responsible for the circuit breakers which protect a host from flapping rules.
+// Every rule has a breaker counting its executions and failures over a sliding window. Once a threshold
+// is crossed the breaker opens and the events of the rule are suppressed until a cooldown passes or
+// an operator resets the breaker. After the cooldown the breaker is half-open, and the next result of
+// the rule either closes it or opens it again. The breakers are kept in a file so that they survive
+// agent restarts and can be reset from the command line while the agent runs.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	breakersFile = ".breakers"
+
+	// Status of the events suppressed by an open breaker.
+	suppressedStatus = "SUPPRESSED"
+
+	defaultBreakerWindowMinutes   = 60
+	defaultBreakerCooldownMinutes = 30
+
+	// Resets the breakers of all the rules.
+	allBreakers = "all"
+
+	// How long to wait for another process, like a reset from the command line, to release the breakers.
+	breakersLockTimeout = 10 * time.Second
+)
+
+// State of the breaker of a rule. Times are in milliseconds. The breaker is open until OpenUntil, and
+// then half-open until the next result of the rule.
+type breakerState struct {
+	Executions []int64 `json:"executions"`
+	Failures   []int64 `json:"failures"`
+	OpenedAt   int64   `json:"openedAt,omitempty"`
+	OpenUntil  int64   `json:"openUntil,omitempty"`
+	HalfOpen   bool    `json:"halfOpen,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// Global variables to hold the breaker settings. Loading and storing the breakers is serialized by
+// the lock within the agent and by a lock file with other processes.
+var breakerConfig CircuitBreakerConfig
+var breakersPath string
+var breakersLock sync.Mutex
+
+// Function to initialize the circuit breakers from agent config. The breakers are kept in the given directory.
+func InitializeCircuitBreakers(config CircuitBreakerConfig, dir string) {
+	if config.WindowMinutes <= 0 {
+		config.WindowMinutes = defaultBreakerWindowMinutes
+	}
+	if config.CooldownMinutes <= 0 {
+		config.CooldownMinutes = defaultBreakerCooldownMinutes
+	}
+	breakerConfig = config
+	breakersPath = filepath.Join(dir, breakersFile)
+
+	logging.Info("Initialized circuit breakers.", logging.Fields{"file": breakersPath, "maxExecutions": config.MaxExecutions,
+		"maxFailures": config.MaxFailures, "window": config.WindowMinutes, "cooldown": config.CooldownMinutes})
+}
+
+func breakersEnabled() bool {
+	return len(breakersPath) > 0 && (breakerConfig.MaxExecutions > 0 || breakerConfig.MaxFailures > 0)
+}
+
+func loadBreakers(path string) (map[string]*breakerState, error) {
+	breakers := map[string]*breakerState{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return breakers, nil
+	} else if err != nil {
+		return breakers, err
+	}
+	err = json.Unmarshal(data, &breakers)
+	return breakers, err
+}
+
+// Function to lock the breakers in the given file for a read-modify-write, against this agent and other
+// processes like a reset from the command line. Returns the function to release the lock. Lock files
+// aren't supported on windows, where only the agent itself is locked out.
+func lockBreakers(path string) func() {
+	breakersLock.Lock()
+
+	deadline := time.Now().Add(breakersLockTimeout)
+	for {
+		f, err := tryLockFile(path+lockFileExtension, true)
+		if f != nil {
+			return func() {
+				unlockFile(f)
+				breakersLock.Unlock()
+			}
+		}
+		if err != nil && err != errHostLocksUnsupported {
+			logging.Warn("Could not lock the circuit breakers file.", logging.Fields{"error": err, "file": path})
+		}
+		if err != nil || time.Now().After(deadline) {
+			return breakersLock.Unlock
+		}
+		time.Sleep(lockFilePollInterval)
+	}
+}
+
+func storeBreakers(path string, breakers map[string]*breakerState) error {
+	data, err := json.Marshal(breakers)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// Function to check if the breaker of the given rule is open. Returns the reason if so. A breaker whose
+// cooldown has passed is half-open with fresh counts, and lets the events of the rule through.
+func isBreakerOpen(ruleId string) (string, bool) {
+	if !breakersEnabled() || len(ruleId) == 0 {
+		return "", false
+	}
+
+	defer lockBreakers(breakersPath)()
+
+	breakers, err := loadBreakers(breakersPath)
+	if err != nil {
+		logging.Warn("Could not load the circuit breakers.", logging.Fields{"error": err, "file": breakersPath})
+		return "", false
+	}
+
+	state, ok := breakers[ruleId]
+	if !ok || state.OpenUntil == 0 || state.HalfOpen {
+		return "", false
+	}
+	if time.Now().UnixNano()/1000000 < state.OpenUntil {
+		return state.Reason, true
+	}
+
+	logging.Info("Half-opening the circuit breaker after cooldown.", logging.Fields{"ruleId": ruleId})
+	breakers[ruleId] = &breakerState{OpenedAt: state.OpenedAt, OpenUntil: state.OpenUntil, HalfOpen: true}
+	if err := storeBreakers(breakersPath, breakers); err != nil {
+		logging.Warn("Could not store the circuit breakers.", logging.Fields{"error": err, "file": breakersPath})
+	}
+	return "", false
+}
+
+// Function to count a finished execution of the given rule and open its breaker if a threshold is crossed.
+// A half-open breaker is closed by a success and opened again by a failure. The breakers of the other
+// rules are dropped once they have been closed or half-open for the whole window without executions.
+func recordBreakerResult(ruleId string, failed bool) {
+	if !breakersEnabled() || len(ruleId) == 0 {
+		return
+	}
+
+	defer lockBreakers(breakersPath)()
+
+	breakers, err := loadBreakers(breakersPath)
+	if err != nil {
+		logging.Warn("Could not load the circuit breakers.", logging.Fields{"error": err, "file": breakersPath})
+		breakers = map[string]*breakerState{}
+	}
+	state, ok := breakers[ruleId]
+	if !ok {
+		state = &breakerState{}
+		breakers[ruleId] = state
+	}
+
+	now := time.Now().UnixNano() / 1000000
+	windowStart := now - int64(breakerConfig.WindowMinutes)*60*1000
+	state.Executions = append(withinWindow(state.Executions, windowStart), now)
+	state.Failures = withinWindow(state.Failures, windowStart)
+	if failed {
+		state.Failures = append(state.Failures, now)
+	}
+
+	if state.HalfOpen {
+		state.HalfOpen = false
+		state.OpenUntil = 0
+		if failed {
+			state.Reason = "Rule failed again after the cooldown."
+		} else {
+			logging.Info("Closing the circuit breaker after a success.", logging.Fields{"ruleId": ruleId})
+		}
+	} else if state.OpenUntil == 0 {
+		if max := breakerConfig.MaxExecutions; max > 0 && len(state.Executions) >= max {
+			state.Reason = fmt.Sprintf("Rule ran %d times in %d minutes.", len(state.Executions), breakerConfig.WindowMinutes)
+		} else if max := breakerConfig.MaxFailures; max > 0 && len(state.Failures) >= max {
+			state.Reason = fmt.Sprintf("Rule failed %d times in %d minutes.", len(state.Failures), breakerConfig.WindowMinutes)
+		}
+	}
+	if state.OpenUntil == 0 && len(state.Reason) > 0 {
+		state.OpenedAt = now
+		state.OpenUntil = now + int64(breakerConfig.CooldownMinutes)*60*1000
+		logging.Warn("Opened the circuit breaker of a flapping rule.", logging.Fields{"ruleId": ruleId, "reason": state.Reason})
+	}
+
+	for id, other := range breakers {
+		if id != ruleId && other.OpenUntil < windowStart && len(withinWindow(other.Executions, windowStart)) == 0 {
+			delete(breakers, id)
+		}
+	}
+
+	if err := storeBreakers(breakersPath, breakers); err != nil {
+		logging.Warn("Could not store the circuit breakers.", logging.Fields{"error": err, "file": breakersPath})
+	}
+}
+
+func withinWindow(times []int64, windowStart int64) []int64 {
+	recent := []int64{}
+	for _, t := range times {
+		if t > windowStart {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// Function to reset the breaker of the given rule, or of all the rules, in the given directory. The running
+// agent picks up the change when it handles the next event of the rule.
+func ResetBreaker(dir, ruleId string) error {
+	path := filepath.Join(dir, breakersFile)
+	defer lockBreakers(path)()
+
+	breakers, err := loadBreakers(path)
+	if err != nil {
+		return err
+	}
+	if ruleId == allBreakers {
+		breakers = map[string]*breakerState{}
+	} else if _, ok := breakers[ruleId]; !ok {
+		return fmt.Errorf("No circuit breaker for rule %s.", ruleId)
+	} else {
+		delete(breakers, ruleId)
+	}
+	return storeBreakers(path, breakers)
+}
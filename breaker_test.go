@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test that a breaker opens once a threshold is crossed, is half-open after the cooldown, and that the
+// next result either closes it or opens it again.
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     CircuitBreakerConfig
+		results    []bool
+		trial      bool
+		wantReopen bool
+	}{
+		{
+			name:    "executions threshold, closed by a success",
+			config:  CircuitBreakerConfig{MaxExecutions: 3},
+			results: []bool{false, false, false},
+			trial:   false,
+		},
+		{
+			name:    "failures threshold, closed by a success",
+			config:  CircuitBreakerConfig{MaxFailures: 2},
+			results: []bool{true, false, true},
+			trial:   false,
+		},
+		{
+			name:       "failures threshold, opened again by a failure",
+			config:     CircuitBreakerConfig{MaxFailures: 2},
+			results:    []bool{true, true},
+			trial:      true,
+			wantReopen: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestBreakers(t, test.config)
+
+			// Closed until the threshold is crossed.
+			for i, failed := range test.results {
+				if _, open := isBreakerOpen("rule"); open {
+					t.Fatalf("breaker is open after %d results", i)
+				}
+				recordBreakerResult("rule", failed)
+			}
+			if reason, open := isBreakerOpen("rule"); !open || len(reason) == 0 {
+				t.Fatalf("isBreakerOpen() = %q, %v, want open with a reason", reason, open)
+			}
+
+			// Half-open once the cooldown has passed.
+			endCooldown(t, "rule")
+			if _, open := isBreakerOpen("rule"); open {
+				t.Fatalf("breaker is still open after the cooldown")
+			}
+			if state := breakerOf(t, "rule"); state == nil || !state.HalfOpen {
+				t.Fatalf("breaker = %+v, want half-open", state)
+			}
+
+			recordBreakerResult("rule", test.trial)
+			state := breakerOf(t, "rule")
+			if _, open := isBreakerOpen("rule"); open != test.wantReopen {
+				t.Errorf("breaker open = %v after the half-open result, want %v", open, test.wantReopen)
+			}
+			if state.HalfOpen || len(state.Executions) != 1 {
+				t.Errorf("breaker = %+v, want no longer half-open with fresh counts", state)
+			}
+		})
+	}
+}
+
+// Test that an operator can reset an open breaker.
+func TestResetBreaker(t *testing.T) {
+	dir := useTestBreakers(t, CircuitBreakerConfig{MaxExecutions: 1})
+
+	recordBreakerResult("rule", false)
+	if _, open := isBreakerOpen("rule"); !open {
+		t.Fatalf("breaker is not open")
+	}
+	if err := ResetBreaker(dir, "rule"); err != nil {
+		t.Fatalf("ResetBreaker() failed: %v", err)
+	}
+	if _, open := isBreakerOpen("rule"); open {
+		t.Errorf("breaker is still open after the reset")
+	}
+	if err := ResetBreaker(dir, "unknown"); err == nil {
+		t.Errorf("ResetBreaker() of an unknown rule succeeded")
+	}
+}
+
+// Test that the breakers of rules which stopped firing are dropped.
+func TestBreakersArePruned(t *testing.T) {
+	useTestBreakers(t, CircuitBreakerConfig{MaxExecutions: 10, WindowMinutes: 60})
+
+	old := time.Now().Add(-2*time.Hour).UnixNano() / 1000000
+	if err := storeBreakers(breakersPath, map[string]*breakerState{
+		"stale":     {Executions: []int64{old}},
+		"half-open": {OpenUntil: old, HalfOpen: true},
+		"open":      {OpenUntil: time.Now().Add(time.Hour).UnixNano() / 1000000},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	recordBreakerResult("rule", false)
+	breakers, err := loadBreakers(breakersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"stale", "half-open"} {
+		if _, ok := breakers[id]; ok {
+			t.Errorf("breaker of %s was not dropped", id)
+		}
+	}
+	for _, id := range []string{"open", "rule"} {
+		if _, ok := breakers[id]; !ok {
+			t.Errorf("breaker of %s was dropped", id)
+		}
+	}
+}
+
+// Function to run a test with the given breaker settings and the breakers kept in a temp directory.
+func useTestBreakers(t *testing.T, config CircuitBreakerConfig) string {
+	dir, err := ioutil.TempDir("", "breakers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, oldPath := breakerConfig, breakersPath
+	t.Cleanup(func() {
+		breakerConfig, breakersPath = oldConfig, oldPath
+		os.RemoveAll(dir)
+	})
+
+	InitializeCircuitBreakers(config, dir)
+	return dir
+}
+
+// Function to move the end of the cooldown of the given rule's breaker to the past.
+func endCooldown(t *testing.T, ruleId string) {
+	breakers, err := loadBreakers(breakersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakers[ruleId].OpenUntil = time.Now().UnixNano()/1000000 - 1
+	if err := storeBreakers(breakersPath, breakers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func breakerOf(t *testing.T, ruleId string) *breakerState {
+	breakers, err := loadBreakers(breakersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return breakers[ruleId]
+}
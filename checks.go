@@ -0,0 +1,250 @@
+// Package checks is responsible for the health checks around a runbook. Pre-checks decide whether
+// the runbook runs at all, and post-checks decide whether the remediation actually worked. A runbook
+// which exits successfully but fails a post-check is reported as failed. Checks can be built in, like
+// an HTTP GET or a TCP connect, or small commands and scripts.
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Types of health checks.
+	httpCheck    = "http"
+	tcpCheck     = "tcp"
+	processCheck = "process"
+	fileCheck    = "file"
+	commandCheck = "command"
+	scriptCheck  = "script"
+
+	preCheckPhase  = "pre"
+	postCheckPhase = "post"
+
+	// Status of an execution whose runbook didn't run because a pre-check failed.
+	precheckFailedStatus = "PRECHECK_FAILED"
+
+	defaultCheckTimeoutSeconds = 10
+)
+
+// Health check to run before or after a runbook. Url and ExpectedStatus are used by http checks, Address
+// (host:port) by tcp checks, Process by process checks, Path by file checks and Command by command and
+// script checks, which pass if they exit with ExpectedExitCode. A failed check is tried again up to
+// Retries times, IntervalSeconds apart, which gives a restarted service time to come up.
+type HealthCheck struct {
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	Url              string `json:"url"`
+	ExpectedStatus   int    `json:"expectedStatus"`
+	Address          string `json:"address"`
+	Process          string `json:"process"`
+	Path             string `json:"path"`
+	Command          string `json:"command"`
+	ExpectedExitCode int    `json:"expectedExitCode"`
+	Timeout          int    `json:"timeout"`
+	Retries          int    `json:"retries"`
+	IntervalSeconds  int    `json:"intervalSeconds"`
+}
+
+// Result of a health check reported to Neptune.io.
+type CheckResult struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Phase      string `json:"phase"`
+	Passed     bool   `json:"passed"`
+	Message    string `json:"message,omitempty"`
+	Attempts   int    `json:"attempts"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+func (c *HealthCheck) validate() error {
+	switch c.Type {
+	case httpCheck:
+		if len(c.Url) == 0 {
+			return fmt.Errorf("Health check %q has no url.", c.Name)
+		}
+	case tcpCheck:
+		if len(c.Address) == 0 {
+			return fmt.Errorf("Health check %q has no address.", c.Name)
+		}
+	case processCheck:
+		if len(c.Process) == 0 {
+			return fmt.Errorf("Health check %q has no process.", c.Name)
+		}
+	case fileCheck:
+		if len(c.Path) == 0 {
+			return fmt.Errorf("Health check %q has no path.", c.Name)
+		}
+	case commandCheck, scriptCheck:
+		if len(c.Command) == 0 {
+			return fmt.Errorf("Health check %q has no command.", c.Name)
+		}
+	default:
+		return fmt.Errorf("Health check %q has unknown type %q.", c.Name, c.Type)
+	}
+	if c.Timeout < 0 || c.Retries < 0 || c.IntervalSeconds < 0 {
+		return fmt.Errorf("Health check %q has a negative timeout or retry setting.", c.Name)
+	}
+	return nil
+}
+
+// Function to get the checks of the given phase for the event. The checks sent with the event run
+// before the ones in the manifest. Checks running commands are only accepted from the event if the
+// agent isn't restricted to Github runbooks.
+func healthChecksFor(event *Event, manifest *RunbookManifest, phase string, githubKey string) ([]HealthCheck, error) {
+	eventChecks, manifestChecks := event.PreChecks, []HealthCheck(nil)
+	if phase == postCheckPhase {
+		eventChecks = event.PostChecks
+	}
+	if manifest != nil {
+		manifestChecks = manifest.PreChecks
+		if phase == postCheckPhase {
+			manifestChecks = manifest.PostChecks
+		}
+	}
+
+	for _, c := range eventChecks {
+		if len(githubKey) > 0 && (c.Type == commandCheck || c.Type == scriptCheck) {
+			return nil, fmt.Errorf("Agent is configured to run Github runbooks only but health check %q runs a command.", c.Name)
+		}
+	}
+	checks := append(append([]HealthCheck{}, eventChecks...), manifestChecks...)
+	for i := range checks {
+		if err := checks[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return checks, nil
+}
+
+// Function to run the given checks in order. Returns the results and whether all of them passed.
+func runHealthChecks(event *Event, checks []HealthCheck, phase string, extraEnv map[string]string) ([]CheckResult, bool) {
+	results := []CheckResult{}
+	passed := true
+	for _, c := range checks {
+		result := runHealthCheck(event, c, phase, extraEnv)
+		logging.Info("Ran health check.", logging.Fields{"eventId": event.EventId, "check": c.Name, "phase": phase,
+			"passed": result.Passed, "message": result.Message})
+		results = append(results, result)
+		passed = passed && result.Passed
+	}
+	return results, passed
+}
+
+func runHealthCheck(event *Event, c HealthCheck, phase string, extraEnv map[string]string) CheckResult {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if c.Timeout == 0 {
+		timeout = defaultCheckTimeoutSeconds * time.Second
+	}
+
+	start := time.Now()
+	result := CheckResult{Name: c.Name, Type: c.Type, Phase: phase}
+	for {
+		result.Attempts++
+		err := checkOnce(event, c, timeout, extraEnv)
+		result.Passed = err == nil
+		if err != nil {
+			result.Message = err.Error()
+		} else {
+			result.Message = ""
+		}
+
+		if result.Passed || result.Attempts > c.Retries {
+			break
+		}
+		time.Sleep(time.Duration(c.IntervalSeconds) * time.Second)
+	}
+	result.DurationMs = int64(time.Since(start) / time.Millisecond)
+	return result
+}
+
+// Function to run the check once. Returns the reason if it failed.
+func checkOnce(event *Event, c HealthCheck, timeout time.Duration, extraEnv map[string]string) error {
+	switch c.Type {
+	case httpCheck:
+		// Unlike the http native action, the URL isn't limited to the allowed hosts. Checks only run
+		// around shell runbooks, which can reach any host themselves, and never when scripts are disabled.
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(c.Url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		expected := c.ExpectedStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			return fmt.Errorf("Got status %d instead of %d.", resp.StatusCode, expected)
+		}
+	case tcpCheck:
+		conn, err := net.DialTimeout("tcp", c.Address, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case processCheck:
+		running, err := isProcessRunning(c.Process)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return fmt.Errorf("Process %s is not running.", c.Process)
+		}
+	case fileCheck:
+		if _, err := os.Stat(c.Path); err != nil {
+			return err
+		}
+	case commandCheck, scriptCheck:
+		return runCheckCommand(event, c, timeout, extraEnv)
+	}
+	return nil
+}
+
+// Function to run the command or script of a check and verify its exit code.
+func runCheckCommand(event *Event, c HealthCheck, timeout time.Duration, extraEnv map[string]string) error {
+	var cmd *exec.Cmd
+	if c.Type == scriptCheck {
+		tmpFile, err := writeToTmpFile(event.EventId+"-check-"+safeFileName(c.Name), "", &c.Command)
+		if err != nil {
+			return errors.New("Could not write the check script to a file.")
+		}
+		defer os.Remove(tmpFile)
+		cmd = scriptCommand(tmpFile, strings.HasPrefix(c.Command, shebangPrefix))
+	} else if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", c.Command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", c.Command)
+	}
+	cmd.Env = commandEnv(event, extraEnv)
+
+	result := runCommand(cmd, timeout, nil, "", nil)
+	if result.Timeout {
+		return errors.New("Check timed out.")
+	}
+	if result.StatusCode != c.ExpectedExitCode {
+		return fmt.Errorf("Exited with code %d instead of %d. %s", result.StatusCode, c.ExpectedExitCode, strings.TrimSpace(result.Stderr))
+	}
+	return nil
+}
+
+// Function to describe the failed checks for the failure reason of an execution.
+func failedChecksReason(results []CheckResult) string {
+	lines := []string{}
+	for _, r := range results {
+		if !r.Passed {
+			lines = append(lines, fmt.Sprintf("%s-check %s failed: %s", r.Phase, r.Name, r.Message))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -28,6 +29,12 @@ var (
 	endPoint         string
 	apiKey           string
 	configFilePath   string
+	showHistory      bool
+	historyFilter    string
+	blackoutCommand  string
+	blackoutReason   string
+	blackoutMinutes  int
+	resetBreaker     string
 	registrationInfo *agent.RegistrationInfo
 )
 
@@ -35,6 +42,12 @@ func init() {
 	flag.StringVar(&endPoint, "endpoint", "", "Neptune.io's API endpoint at which the agent should register.")
 	flag.StringVar(&apiKey, "api_key", "", "Neptune.io api key for your account. Get this from Neptune.io app.")
 	flag.StringVar(&configFilePath, "config", "", "Path to the agent config file.")
+	flag.BoolVar(&showHistory, "history", false, "Print the local execution history and exit.")
+	flag.StringVar(&historyFilter, "history_filter", "", "Filter for -history, like \"ruleId=abc&status=FAILED&limit=10\".")
+	flag.StringVar(&blackoutCommand, "blackout", "", "Turn the manual blackout \"on\" or \"off\", or print its \"status\", and exit.")
+	flag.StringVar(&blackoutReason, "blackout_reason", "", "Reason for -blackout on, reported in heartbeats.")
+	flag.IntVar(&blackoutMinutes, "blackout_minutes", 0, "End the blackout turned on with -blackout on after these many minutes.")
+	flag.StringVar(&resetBreaker, "reset_breaker", "", "Reset the circuit breaker of the given rule id, or of \"all\" rules, and exit.")
 }
 
 // Function to validate the NeptuneConfig object.
@@ -70,6 +83,46 @@ func registerAgent(metaData *agent.HostMetaData, neptuneConfig *agent.NeptuneCon
 	}
 }
 
+// Function to print the local execution history as JSON lines.
+func printHistory() error {
+	filter, err := agent.ParseHistoryFilter(historyFilter)
+	if err != nil {
+		return err
+	}
+
+	records, err := agent.QueryHistoryFile(filepath.Dir(configFilePath), filter)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+	return nil
+}
+
+// Function to turn the manual blackout on or off, or print the current blackout state.
+func runBlackoutCommand() error {
+	dir := filepath.Dir(configFilePath)
+	switch blackoutCommand {
+	case "on":
+		return agent.SetManualBlackout(dir, true, blackoutReason, time.Duration(blackoutMinutes)*time.Minute)
+	case "off":
+		return agent.SetManualBlackout(dir, false, "", 0)
+	case "status":
+		// Blackout windows come from the config file, so the status can't be told without it.
+		_, agentConfig, err := agent.GetConfig(configFilePath, agent.NeptuneConfig{}, make(chan error, 1))
+		if err != nil {
+			return err
+		}
+		agent.InitializeBlackout(agentConfig.Blackout, dir)
+		return json.NewEncoder(os.Stdout).Encode(agent.CurrentBlackout())
+	default:
+		return fmt.Errorf("Unknown blackout command %q.", blackoutCommand)
+	}
+}
+
 // Main function for the agent which does the bootstrapping and starting all workers.
 func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 	// Parse the commandline flags.
@@ -87,6 +140,35 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 		}
 	}
 
+	// Local tooling commands which don't start the agent.
+	if showHistory {
+		if err := printHistory(); err != nil {
+			fmt.Printf("Could not read the execution history. Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(resetBreaker) > 0 {
+		if err := agent.ResetBreaker(filepath.Dir(configFilePath), resetBreaker); err != nil {
+			fmt.Printf("Could not reset the circuit breaker. Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(blackoutCommand) > 0 {
+		if err := runBlackoutCommand(); err != nil {
+			fmt.Printf("Could not run the blackout command. Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Load Neptune.io's public key, without which no message can be verified.
+	if err := agent.InitializePublicKey(); err != nil {
+		fmt.Println("Could not load public key.", err)
+		os.Exit(1)
+	}
+
 	// Construct a config object from the flags passed to the agent.
 	cmdlineConfig := agent.NeptuneConfig{Endpoint: endPoint, ApiKey: apiKey}
 	neptuneConfig, agentConfig, err := agent.GetConfig(configFilePath, cmdlineConfig, errorChannel)
@@ -106,6 +188,13 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 		agent.UpdateStatus(agent.ConfigReadSucceeded)
 	}
 
+	// Make sure the credentials in the config never show up in logs or uploaded errors.
+	logging.AddSensitiveValues(neptuneConfig.ApiKey, agentConfig.GithubApiKey, agentConfig.Secrets.Vault.Token)
+	if e := logging.SetRedactionPatterns(agentConfig.Redaction.Patterns, agentConfig.Redaction.DisableBuiltinPatterns); e != nil {
+		errorChannel <- e
+		agent.ReportError(fmt.Sprintf("Invalid redaction config. Error: %v", e))
+	}
+
 	// Get the absolute path of the log file and use that to setup logging.
 	logFilePath := agentConfig.LogFile
 	if !filepath.IsAbs(agentConfig.LogFile) {
@@ -129,6 +218,9 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 		os.Exit(1)
 	}
 
+	// Load the action plugins so that they are reported on registration.
+	agent.InitializePlugins(agentConfig.Plugins, filepath.Dir(configFilePath))
+
 	i := 0
 	for {
 		registrationInfo, e = agent.RegisterAgent(metaData, &neptuneConfig)
@@ -150,8 +242,41 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 	// Set the registration info the apis.
 	agent.SetRegistrationInfo(registrationInfo, metaData, neptuneConfig)
 
+	// Initialize the providers used to resolve the secrets referenced by runbooks.
+	agent.InitializeSecretProviders(agentConfig.Secrets, filepath.Dir(configFilePath))
+
+	// Initialize the quotas and upload settings for runbook artifacts.
+	agent.InitializeArtifacts(agentConfig.Artifacts)
+
+	// Initialize the truncation settings for runbook output.
+	agent.InitializeOutput(agentConfig.Output)
+
+	// Initialize the retry policies of failed runbooks.
+	agent.InitializeRetries(agentConfig.Retry)
+
+	// Initialize the tracing of events, if enabled.
+	agent.InitializeTracing(agentConfig.Tracing)
+
+	// Initialize the native actions and the policy on shell scripts.
+	agent.InitializeNativeActions(agentConfig.NativeActions)
+
+	// Initialize the per-execution records kept on the host.
+	agent.InitializeExecutionRecords(agentConfig.Executions, filepath.Dir(configFilePath))
+
+	// Initialize the local execution history store.
+	agent.InitializeHistory(agentConfig.History, filepath.Dir(configFilePath))
+
+	// Initialize the blackout windows during which no runbook runs.
+	agent.InitializeBlackout(agentConfig.Blackout, filepath.Dir(configFilePath))
+
+	// Initialize the circuit breakers of flapping rules.
+	agent.InitializeCircuitBreakers(agentConfig.CircuitBreaker, filepath.Dir(configFilePath))
+
+	// Initialize the named locks between runbooks.
+	agent.InitializeLocks(agentConfig.Locks, filepath.Dir(configFilePath))
+
 	// Initialize the events file cleaner.
-	agent.InitializeEventsFile(filepath.Dir(configFilePath))
+	agent.InitializeEventsFile(filepath.Dir(configFilePath), agentConfig.Dedupe)
 
 	heartbeatTickerCh := time.NewTicker(heartbeatInterval).C
 	uploadLogsTickerCh := time.NewTicker(logsUploadInterval).C
@@ -166,6 +291,11 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 	regInfoUpdatesCh := make(chan string, 5)
 	triggerReregistrationCh := make(chan time.Time, 5)
 
+	// Start the local control API, if enabled.
+	if e := agent.StartControlAPI(agentConfig.Control, filepath.Dir(configFilePath), registrationInfo, triggerReregistrationCh); e != nil {
+		logging.Error("Could not start the control API.", logging.Fields{"error": e})
+	}
+
 	// Start a GO routine to handle periodic agent registration, heartbeats and log uploads.
 	go func() {
 		for {
@@ -195,6 +325,20 @@ func MainLoop(errorChannel chan error, exitChannel chan struct{}) error {
 	events := make(chan *agent.Event, 10)
 	actionOutputs := make(chan *agent.ActionOutputMessage, 10)
 
+	// Start serving the metrics, if enabled.
+	if e := agent.StartMetrics(agentConfig.Metrics, actionOutputs); e != nil {
+		logging.Error("Could not start serving the metrics.", logging.Fields{"error": e})
+	}
+
+	// Report the executions interrupted by the previous run of the agent, before running any new event.
+	agent.RecoverInterruptedExecutions(registrationInfo, actionOutputs, agentConfig.Recovery)
+
+	// Start the runbooks scheduled locally on the agent.
+	agent.StartScheduler(agentConfig.Scheduler, filepath.Dir(configFilePath), registrationInfo, actionOutputs, agentConfig.GithubApiKey)
+
+	// Start the local triggers watching the host.
+	agent.StartTriggers(agentConfig.Triggers, registrationInfo, actionOutputs, agentConfig.GithubApiKey)
+
 	// Start a GO routine to process SQS messages in an infinite loop.
 	go func() {
 		agent.RunLoop(registrationInfo, regInfoUpdatesCh, events, triggerReregistrationCh)
@@ -26,6 +26,213 @@ type AgentConfig struct {
 	LogFile          string
 	DebugMode        bool
 	GithubApiKey     string
+	Secrets          SecretsConfig
+	Redaction        RedactionConfig
+	Artifacts        ArtifactsConfig
+	Output           OutputConfig
+	Executions       ExecutionsConfig
+	History          HistoryConfig
+	Dedupe           DedupeConfig
+	Recovery         RecoveryConfig
+	Retry            RetryConfig
+	Blackout         BlackoutConfig
+	CircuitBreaker   CircuitBreakerConfig
+	Locks            LocksConfig
+	Scheduler        SchedulerConfig
+	Triggers         TriggersConfig
+	NativeActions    NativeActionsConfig
+	Plugins          PluginsConfig
+	Control          ControlConfig
+	Metrics          MetricsConfig
+	Tracing          TracingConfig
+}
+
+// Tracing section of the config file. If Enabled, the handling of every event is traced and the spans
+// are exported every FlushIntervalSeconds, 5 by default, over OTLP/HTTP to Endpoint, which defaults to
+// "http://127.0.0.1:4318/v1/traces". ServiceName defaults to "neptune-agent".
+type TracingConfig struct {
+	Enabled              bool
+	Endpoint             string
+	ServiceName          string
+	FlushIntervalSeconds int
+}
+
+// Metrics section of the config file. If Enabled, the Prometheus metrics are served at /metrics on
+// Address, which defaults to "127.0.0.1:9779". They are also served by the control API.
+type MetricsConfig struct {
+	Enabled bool
+	Address string
+}
+
+// Control section of the config file. If Enabled, the control API is served on a Unix socket at Socket,
+// which defaults to "agent.sock" next to the config file. If TCPAddress is set, the API is also served
+// there, which must be a loopback address, and requests must carry Token as a bearer token.
+type ControlConfig struct {
+	Enabled    bool
+	Socket     string
+	TCPAddress string
+	Token      string
+}
+
+// Plugins section of the config file. Plugins are the executables in Dir, which defaults to "plugins"
+// next to the config file. They must answer the capabilities handshake within HandshakeTimeoutSeconds.
+type PluginsConfig struct {
+	Dir                     string
+	HandshakeTimeoutSeconds int
+}
+
+// Native actions section of the config file. If DisableScripts is set, only native and plugin actions
+// run and events with shell scripts are rejected. File actions may only access the files under AllowedPaths,
+// HTTP requests may only be sent to AllowedHosts, given as host or host:port, and only the processes named
+// in AllowedProcessNames may be killed. Each allows nothing if it's empty. Native actions listed in Disabled
+// are rejected.
+type NativeActionsConfig struct {
+	DisableScripts      bool
+	AllowedPaths        []string
+	AllowedHosts        []string
+	AllowedProcessNames []string
+	Disabled            []string
+}
+
+// Triggers section of the config file. Watchers are local triggers which watch log files, paths,
+// processes or ports and run a runbook locally or send an event to Neptune.io when they fire.
+type TriggersConfig struct {
+	Watchers []LocalTrigger
+}
+
+// Scheduler section of the config file. Jobs are runbooks run locally on cron schedules. More jobs can
+// be kept in JobsDir, one JSON job file each.
+type SchedulerConfig struct {
+	Jobs    []ScheduledJob
+	JobsDir string
+}
+
+// Locks section of the config file. Runbooks maps runbook names or Github file paths to the locks they
+// need, in addition to the ones declared by events and manifests. If HostWide is set, every lock is
+// also taken as a flock on a file in Dir, which defaults to "locks" next to the config file.
+type LocksConfig struct {
+	Runbooks           map[string][]LockSpec
+	DefaultWaitSeconds int
+	HostWide           bool
+	Dir                string
+}
+
+// CircuitBreaker section of the config file. The breaker of a rule opens when, within WindowMinutes,
+// the rule ran MaxExecutions times or failed MaxFailures times. Events of the rule are then suppressed
+// until CooldownMinutes pass or the breaker is reset. The breaker is then half-open, and the next result
+// of the rule closes it if it succeeded or opens it again if it failed. A threshold of 0 is disabled.
+type CircuitBreakerConfig struct {
+	WindowMinutes   int
+	MaxExecutions   int
+	MaxFailures     int
+	CooldownMinutes int
+}
+
+// Blackout section of the config file. Policy is "defer" or "reject" and decides what happens to the
+// events received during a blackout. Deferred events are released back to the queue, so like any
+// other event they are dropped as stale if the blackout outlasts the staleness timeout.
+type BlackoutConfig struct {
+	Policy  string
+	Windows []BlackoutWindowConfig
+}
+
+// Blackout window. A one-off window goes from Start to End, both in RFC3339 format. A recurring window
+// starts at every minute matching the Cron expression, in local time, and lasts DurationMinutes.
+type BlackoutWindowConfig struct {
+	Name            string
+	Start           string
+	End             string
+	Cron            string
+	DurationMinutes int
+}
+
+// Retry section of the config file. Runbooks maps runbook names or Github file paths to their retry
+// policy and Default applies to all other runbooks. A policy sent with the event takes precedence over
+// both. BudgetPerRulePerHour limits the number of retries of a rule, 0 means no limit.
+type RetryConfig struct {
+	Default              *RetryPolicy
+	Runbooks             map[string]RetryPolicy
+	BudgetPerRulePerHour int
+}
+
+// Recovery section of the config file. OrphanPolicy is "kill" or "adopt" and decides what happens to
+// the still running process of an execution interrupted by an agent restart.
+type RecoveryConfig struct {
+	OrphanPolicy string
+}
+
+// Dedupe section of the config file, listing the idempotency keys used to detect duplicate events.
+type DedupeConfig struct {
+	Keys []DedupeKeyConfig
+}
+
+// Idempotency key. Type is one of "EventId", "InflightActionId", "RuleWindow" or "ContentHash".
+// Window is only used by "RuleWindow" keys, which treat any event of a rule as a duplicate within the window.
+type DedupeKeyConfig struct {
+	Type             string
+	RetentionMinutes int
+	WindowSeconds    int
+}
+
+// History section of the config file, controlling how long the local execution history is kept.
+type HistoryConfig struct {
+	MaxSizeMB     int
+	RetentionDays int
+}
+
+// Executions section of the config file, controlling where execution records are kept and for how long.
+type ExecutionsConfig struct {
+	Dir            string
+	MaxAgeHours    int
+	MaxTotalSizeMB int
+}
+
+// Output section of the config file. Truncation is one of "head", "tail" or "headtail".
+type OutputConfig struct {
+	Truncation         string
+	MaxSizeKB          int
+	CombinedTranscript bool
+}
+
+// Artifacts section of the config file. Artifacts are uploaded through pre-signed URLs from
+// Neptune.io unless an upload endpoint accepting multipart uploads is configured. Like the Neptune.io
+// endpoint, UploadEndpoint is a host name and uploads go to its agent API. They are authenticated with
+// UploadToken as a bearer token, if set. The Neptune.io API key is never sent to the upload endpoint.
+type ArtifactsConfig struct {
+	MaxFiles       int
+	MaxFileSizeMB  int
+	MaxTotalSizeMB int
+	UploadEndpoint string
+	UploadToken    string
+}
+
+// Redaction section of the config file. Known secret values are always masked; these patterns
+// are masked in addition to them.
+type RedactionConfig struct {
+	Patterns               []string
+	DisableBuiltinPatterns bool
+}
+
+// Secrets section of the config file. Each configured provider is consulted in the
+// order file vault, env files and Vault when a runbook references a secret by name.
+type SecretsConfig struct {
+	FileVault FileVaultConfig
+	EnvFiles  []string
+	Vault     VaultConfig
+}
+
+// Encrypted file vault holding a JSON object of secret names to values.
+type FileVaultConfig struct {
+	Path    string
+	KeyFile string
+}
+
+// HashiCorp Vault compatible HTTP API used to look up secrets.
+type VaultConfig struct {
+	Address   string
+	Token     string
+	TokenFile string
+	Mount     string
 }
 
 const (
@@ -0,0 +1,306 @@
+// Package control is responsible for the local control API, which lets operators and local tooling ask
+// the running agent what it is doing. The API is served over HTTP on a Unix domain socket, which only
+// the agent's user can access, and optionally on a loopback TCP address which requires a token. It
+// reports the status, registration, running executions, queue stats, history, blackout and metrics of
+// the agent, and can cancel executions and trigger a re-registration.
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	defaultControlSocket = "agent.sock"
+	controlTokenHeader   = "Authorization"
+	controlTokenPrefix   = "Bearer "
+)
+
+// Status of the agent reported by the control API.
+type ControlStatus struct {
+	Status       string         `json:"status"`
+	AgentVersion string         `json:"agentVersion"`
+	AgentId      string         `json:"agentId"`
+	Hostname     string         `json:"hostname"`
+	StartTime    int64          `json:"startTime"`
+	Inflight     int            `json:"inflight"`
+	Blackout     BlackoutStatus `json:"blackout"`
+}
+
+// Registration info reported by the control API, without the AWS credentials.
+type ControlRegistration struct {
+	AgentId             string       `json:"agentId"`
+	CreateTime          int64        `json:"createTime"`
+	UpdateTime          int64        `json:"updateTime"`
+	ActionQueueEndpoint string       `json:"actionQueueEndpoint"`
+	Plugins             []PluginInfo `json:"plugins"`
+}
+
+// Error returned by the control API.
+type ControlError struct {
+	Error string `json:"error"`
+}
+
+// Server of the control API. Reregister is signalled to trigger a re-registration.
+type controlServer struct {
+	regInfo    *RegistrationInfo
+	reregister chan<- time.Time
+	token      string
+}
+
+// Function to start the control API if it's enabled in agent config. The socket is created in the
+// configured path, or as "agent.sock" in the given directory.
+func StartControlAPI(config ControlConfig, dir string, regInfo *RegistrationInfo, reregister chan<- time.Time) error {
+	if !config.Enabled {
+		return nil
+	}
+	if len(config.TCPAddress) > 0 {
+		if err := validateLoopbackAddress(config.TCPAddress); err != nil {
+			return err
+		}
+		if len(config.Token) == 0 {
+			return errors.New("Control API token is required for the TCP listener.")
+		}
+	}
+
+	server := &controlServer{regInfo: regInfo, reregister: reregister, token: config.Token}
+	socketPath := absPath(dir, config.Socket)
+	if len(socketPath) == 0 {
+		socketPath = filepath.Join(dir, defaultControlSocket)
+	}
+
+	// Remove the socket left behind by a previous run of the agent.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := listenPrivateSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	go server.serve(listener, server.handler(false))
+	logging.Info("Started the control API.", logging.Fields{"socket": socketPath})
+
+	if len(config.TCPAddress) > 0 {
+		tcpListener, err := net.Listen("tcp", config.TCPAddress)
+		if err != nil {
+			return err
+		}
+		go server.serve(tcpListener, server.handler(true))
+		logging.Info("Started the control API on TCP.", logging.Fields{"address": config.TCPAddress})
+	}
+	return nil
+}
+
+// Function to listen on a Unix socket which only the agent's user can connect to. The socket is created
+// in a private directory and moved into place once its mode is restricted, so that others can't connect
+// in between. File modes don't restrict sockets on windows.
+func listenPrivateSocket(path string) (net.Listener, error) {
+	if runtime.GOOS == "windows" {
+		return net.Listen("unix", path)
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(path))
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is moved, so it's removed by the next start rather than when the listener closes.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, 0600); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Function to check that the given address only listens on the loopback interface.
+func validateLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid control API address. %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Control API address %s is not a loopback address.", address)
+	}
+	return nil
+}
+
+func (s *controlServer) serve(listener net.Listener, handler http.Handler) {
+	if err := http.Serve(listener, handler); err != nil {
+		logging.Error("Control API stopped.", logging.Fields{"error": err, "address": listener.Addr().String()})
+	}
+}
+
+// Function to build the handler of the control API. Requests over TCP must carry the token.
+func (s *controlServer) handler(requireToken bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.getOnly(s.status))
+	mux.HandleFunc("/registration", s.getOnly(s.registration))
+	mux.HandleFunc("/executions", s.getOnly(s.executions))
+	mux.HandleFunc("/executions/", s.cancel)
+	mux.HandleFunc("/queue", s.getOnly(s.queue))
+	mux.HandleFunc("/history", s.history)
+	mux.HandleFunc("/blackout", s.getOnly(s.blackout))
+	mux.HandleFunc("/register", s.register)
+	mux.HandleFunc(metricsPath, serveMetrics)
+
+	if !requireToken {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get(controlTokenHeader), controlTokenPrefix)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeControlError(w, http.StatusUnauthorized, "Missing or invalid token.")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *controlServer) getOnly(handler func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControlError(w, http.StatusMethodNotAllowed, "Only GET is allowed.")
+			return
+		}
+		response, err := handler()
+		if err != nil {
+			writeControlError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeControlResponse(w, http.StatusOK, response)
+	}
+}
+
+func (s *controlServer) status() (interface{}, error) {
+	status := ControlStatus{
+		Status:       CurrentStatus().String(),
+		AgentVersion: AgentVersion,
+		AgentId:      s.regInfo.AgentId,
+		Hostname:     hostname,
+		StartTime:    startTime,
+		Inflight:     len(InflightExecutions()),
+		Blackout:     CurrentBlackout(),
+	}
+	if md != nil {
+		status.Hostname = md.HostName
+	}
+	return status, nil
+}
+
+func (s *controlServer) registration() (interface{}, error) {
+	return ControlRegistration{
+		AgentId:             s.regInfo.AgentId,
+		CreateTime:          s.regInfo.CreateTime,
+		UpdateTime:          s.regInfo.UpdateTime,
+		ActionQueueEndpoint: s.regInfo.ActionQueueEndpoint,
+		Plugins:             listPlugins(),
+	}, nil
+}
+
+func (s *controlServer) executions() (interface{}, error) {
+	return InflightExecutions(), nil
+}
+
+func (s *controlServer) queue() (interface{}, error) {
+	return CurrentQueueStats(), nil
+}
+
+// Function to query the history with a GET to "/history", filtered like the -history command.
+func (s *controlServer) history(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeControlError(w, http.StatusMethodNotAllowed, "Only GET is allowed.")
+		return
+	}
+
+	filter, err := ParseHistoryFilter(r.URL.RawQuery)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	records, err := QueryHistory(filter)
+	if err != nil {
+		writeControlError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeControlResponse(w, http.StatusOK, records)
+}
+
+func (s *controlServer) blackout() (interface{}, error) {
+	return CurrentBlackout(), nil
+}
+
+// Function to cancel an execution with a POST to "/executions/<eventId>/cancel".
+func (s *controlServer) cancel(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/executions/")
+	if !strings.HasSuffix(path, "/cancel") {
+		writeControlError(w, http.StatusNotFound, "Unknown endpoint.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, "Only POST is allowed.")
+		return
+	}
+
+	eventId := strings.TrimSuffix(path, "/cancel")
+	if err := CancelExecution(eventId); err == errExecutionNotFound {
+		writeControlError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeControlError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeControlResponse(w, http.StatusAccepted, map[string]string{"eventId": eventId})
+}
+
+// Function to trigger a re-registration with a POST to "/register".
+func (s *controlServer) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, "Only POST is allowed.")
+		return
+	}
+
+	select {
+	case s.reregister <- time.Now():
+		logging.Info("Re-registration requested through the control API.", nil)
+		writeControlResponse(w, http.StatusAccepted, map[string]string{"status": "requested"})
+	default:
+		writeControlError(w, http.StatusServiceUnavailable, "Re-registration is already pending.")
+	}
+}
+
+func writeControlResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.Warn("Could not write the control API response.", logging.Fields{"error": err})
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, message string) {
+	writeControlResponse(w, status, ControlError{Error: message})
+}
@@ -0,0 +1,161 @@
+// Package util contains the utility code used in Neptune.io agent.
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule parsed from a cron expression with the standard five fields: minute, hour, day of month,
+// month and day of week. Each field is a set of the matching values. As in cron, if both day of month
+// and day of week are restricted, a day matches if either of them matches.
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+// Shorthands for the common schedules.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Function to parse a cron expression like "*/15 2-4 * * 1-5". Fields can be "*", a value, a range,
+// a list of them, and can have a step.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression %q must have 5 fields.", expr)
+	}
+
+	c := &cronSchedule{}
+	var err error
+	if c.minutes, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hours, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.days, c.daysRestricted, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.months, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.weekdays, c.weekdaysRestricted, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+
+	// Both 0 and 7 mean Sunday.
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+	return c, nil
+}
+
+// Function to parse a field into the set of values it matches. Also returns whether the field is
+// restricted, that is, not "*".
+func parseCronField(field string, min, max int) (uint64, bool, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, false, fmt.Errorf("Invalid step in cron field %q.", field)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, false, fmt.Errorf("Invalid value in cron field %q.", field)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, false, fmt.Errorf("Invalid range in cron field %q.", field)
+				}
+			} else if step > 1 {
+				// "5/10" means every 10 starting at 5.
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, false, fmt.Errorf("Cron field %q is out of range %d-%d.", field, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	if set == 0 {
+		return 0, false, errors.New("Empty cron field.")
+	}
+	return set, field != "*", nil
+}
+
+// Function to check if the schedule matches the minute of the given time.
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minutes&(1<<uint(t.Minute())) != 0 &&
+		c.hours&(1<<uint(t.Hour())) != 0 &&
+		c.matchesDay(t)
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	if c.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dayMatches := c.days&(1<<uint(t.Day())) != 0
+	weekdayMatches := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if c.daysRestricted && c.weekdaysRestricted {
+		return dayMatches || weekdayMatches
+	}
+	return dayMatches && weekdayMatches
+}
+
+// Function to get the first time after the given time which matches the schedule. Returns zero time if
+// nothing matches within the next five years, like for the 31st of February.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minutes&(1<<uint(t.Minute())) != 0 {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
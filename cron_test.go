@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that invalid cron expressions are rejected.
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "* * * * *"},
+		{expr: "*/15 2-4 * * 1-5"},
+		{expr: "0,30 9 1 1,7 *"},
+		{expr: "5/10 * * * *"},
+		{expr: "0 0 * * 7"},
+		{expr: "@daily"},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+		{expr: "@sometimes", wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %v", test.expr, err, test.wantErr)
+		}
+	}
+}
+
+// Test the next run of the schedules, starting on Monday 2024-01-15 10:07:30.
+func TestCronNext(t *testing.T) {
+	after := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "* * * * *", want: time.Date(2024, 1, 15, 10, 8, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", want: time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{expr: "5/10 * * * *", want: time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{expr: "0 9 * * *", want: time.Date(2024, 1, 16, 9, 0, 0, 0, time.UTC)},
+		{expr: "30 2-4 * * 6", want: time.Date(2024, 1, 20, 2, 30, 0, 0, time.UTC)},
+		{expr: "0 0 * * 7", want: time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{expr: "@monthly", want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 12 31 12 *", want: time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week matches when both are restricted.
+		{expr: "0 0 20 * 3", want: time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 31 2 *", want: time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q) failed: %v", test.expr, err)
+		}
+		if got := schedule.next(after); !got.Equal(test.want) {
+			t.Errorf("next() of %q = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package state contains logic to maintain an event store on Agent to remember the recently
+// processed events. This file contains the idempotency keys which decide when two events are
+// duplicates of each other. Each key type has its own retention in the event store.
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Types of idempotency keys.
+	eventIdDedupeKey     = "EventId"
+	inflightDedupeKey    = "InflightActionId"
+	ruleWindowDedupeKey  = "RuleWindow"
+	contentHashDedupeKey = "ContentHash"
+
+	// Prefixes of the keys in the event store. Event ids are stored without prefix, as older agents did.
+	inflightKeyPrefix    = "inflight:"
+	ruleWindowKeyPrefix  = "rule:"
+	contentHashKeyPrefix = "content:"
+
+	defaultRuleWindowSeconds = 5 * 60
+
+	duplicateHistoryKind = "duplicate"
+	duplicateStatus      = "DUPLICATE"
+)
+
+// Idempotency key along with how long it's remembered.
+type dedupeKey struct {
+	Type      string
+	Retention time.Duration
+}
+
+// Global variable to hold the configured idempotency keys. Events are deduplicated on event id only
+// unless configured otherwise.
+var dedupeKeys = []dedupeKey{{Type: eventIdDedupeKey, Retention: eventCleanupInterval}}
+
+// Lock making the check and reservation of the keys of an event atomic.
+var dedupeLock sync.Mutex
+
+// Function to set the idempotency keys from agent config.
+func initializeDedupeKeys(config DedupeConfig) {
+	if len(config.Keys) == 0 {
+		return
+	}
+
+	keys := []dedupeKey{}
+	for _, k := range config.Keys {
+		key := dedupeKey{Type: k.Type, Retention: time.Duration(k.RetentionMinutes) * time.Minute}
+
+		switch k.Type {
+		case eventIdDedupeKey, inflightDedupeKey, contentHashDedupeKey:
+			if key.Retention <= 0 {
+				key.Retention = eventCleanupInterval
+			}
+		case ruleWindowDedupeKey:
+			// Within the window, any other event of the same rule is a duplicate.
+			if k.WindowSeconds <= 0 {
+				k.WindowSeconds = defaultRuleWindowSeconds
+			}
+			key.Retention = time.Duration(k.WindowSeconds) * time.Second
+		default:
+			logging.Warn("Ignoring unknown idempotency key type.", logging.Fields{"type": k.Type})
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	// Deduplicating on nothing at all would run every redelivered message again, so keep the default.
+	if len(keys) == 0 {
+		logging.Warn("No valid idempotency key is configured. Deduplicating events on event id only.", nil)
+		return
+	}
+
+	logging.Info("Initialized idempotency keys.", logging.Fields{"keys": keys})
+	dedupeKeys = keys
+}
+
+// Function to get the value of an idempotency key for the given event, as stored in the event store.
+// Returns empty string if the event doesn't have a value for the key. Local events only have an event
+// id, since every run of a scheduled job or trigger has the same rule and content.
+func dedupeKeyValue(keyType string, event *Event) string {
+	if event.local && keyType != eventIdDedupeKey {
+		return ""
+	}
+
+	switch keyType {
+	case eventIdDedupeKey:
+		return event.EventId
+	case inflightDedupeKey:
+		if len(event.InflightActionId) > 0 {
+			return inflightKeyPrefix + event.InflightActionId
+		}
+	case ruleWindowDedupeKey:
+		if len(event.RuleId) > 0 {
+			return ruleWindowKeyPrefix + event.RuleId
+		}
+	case contentHashDedupeKey:
+		return contentHashKeyPrefix + eventContentHash(event)
+	}
+	return ""
+}
+
+// Function to compute the hash of what the event would execute, irrespective of its ids.
+func eventContentHash(event *Event) string {
+	envKeys := []string{}
+	for k := range event.Environment {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+
+	hash := sha256.New()
+	for _, part := range []string{event.RuleId, event.ActionType, event.RunbookName, event.GithubFilePath, event.RawCommand} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	for _, k := range envKeys {
+		hash.Write([]byte(k + "=" + event.Environment[k]))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Function to get the retention of a key in the event store based on its prefix.
+func dedupeRetention(key string) time.Duration {
+	keyType := eventIdDedupeKey
+	switch {
+	case strings.HasPrefix(key, inflightKeyPrefix):
+		keyType = inflightDedupeKey
+	case strings.HasPrefix(key, ruleWindowKeyPrefix):
+		keyType = ruleWindowDedupeKey
+	case strings.HasPrefix(key, contentHashKeyPrefix):
+		keyType = contentHashDedupeKey
+	}
+
+	for _, k := range dedupeKeys {
+		if k.Type == keyType {
+			return k.Retention
+		}
+	}
+	return eventCleanupInterval
+}
+
+// Function to check if the given event is a duplicate of an event processed earlier based on the
+// configured idempotency keys. Returns the type of the key which matched. Otherwise all the keys of
+// the event are reserved right away, so that a concurrent duplicate is caught before the event is
+// persisted. The keys must be released if the event is left to be redelivered.
+func findDuplicate(event *Event) (string, bool) {
+	if eventIdToTimestamp == nil {
+		return "", false
+	}
+
+	dedupeLock.Lock()
+	defer dedupeLock.Unlock()
+
+	now := time.Now()
+	values := []string{}
+	for _, k := range dedupeKeys {
+		value := dedupeKeyValue(k.Type, event)
+		if len(value) == 0 {
+			continue
+		}
+
+		if timestamp, ok := eventIdToTimestamp.Get(value); ok && now.Sub(time.Unix(timestamp, 0)) <= k.Retention {
+			return k.Type, true
+		}
+		values = append(values, value)
+	}
+
+	for _, value := range values {
+		eventIdToTimestamp.Set(value, now.Unix())
+	}
+	return "", false
+}
+
+// Function to release the keys reserved for the given event, which is going to be redelivered.
+func releaseDuplicateKeys(event *Event) {
+	if eventIdToTimestamp == nil {
+		return
+	}
+
+	dedupeLock.Lock()
+	defer dedupeLock.Unlock()
+
+	for _, k := range dedupeKeys {
+		if value := dedupeKeyValue(k.Type, event); len(value) > 0 {
+			eventIdToTimestamp.Remove(value)
+		}
+	}
+}
+
+// Function to record the decision of discarding a duplicate event in the execution history.
+func recordDuplicate(event *Event, keyType string) {
+	now := time.Now().UnixNano() / 1000000
+	recordHistory(HistoryRecord{
+		Kind:             duplicateHistoryKind,
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		InflightActionId: event.InflightActionId,
+		StartTime:        now,
+		EndTime:          now,
+		Status:           duplicateStatus,
+		DedupeKey:        keyType,
+	})
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that each type of idempotency key catches the duplicates of an event within its retention.
+func TestFindDuplicate(t *testing.T) {
+	event := &Event{EventId: "event-1", RuleId: "rule-1", InflightActionId: "inflight-1", RawCommand: "uptime"}
+
+	tests := []struct {
+		name      string
+		key       DedupeKeyConfig
+		duplicate *Event
+		other     *Event
+	}{
+		{
+			name:      "event id",
+			key:       DedupeKeyConfig{Type: eventIdDedupeKey},
+			duplicate: &Event{EventId: "event-1", RuleId: "rule-2"},
+			other:     &Event{EventId: "event-2", RuleId: "rule-1"},
+		},
+		{
+			name:      "inflight action id",
+			key:       DedupeKeyConfig{Type: inflightDedupeKey},
+			duplicate: &Event{EventId: "event-2", InflightActionId: "inflight-1"},
+			other:     &Event{EventId: "event-2", InflightActionId: "inflight-2"},
+		},
+		{
+			name:      "content hash",
+			key:       DedupeKeyConfig{Type: contentHashDedupeKey},
+			duplicate: &Event{EventId: "event-2", RuleId: "rule-1", RawCommand: "uptime"},
+			other:     &Event{EventId: "event-2", RuleId: "rule-1", RawCommand: "df -h"},
+		},
+		{
+			name:      "rule window",
+			key:       DedupeKeyConfig{Type: ruleWindowDedupeKey, WindowSeconds: 60},
+			duplicate: &Event{EventId: "event-2", RuleId: "rule-1"},
+			other:     &Event{EventId: "event-2", RuleId: "rule-2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetDedupe(t, test.key)
+
+			if keyType, ok := findDuplicate(event); ok {
+				t.Fatalf("findDuplicate() of the first event matched %s", keyType)
+			}
+			if keyType, ok := findDuplicate(test.duplicate); !ok || keyType != test.key.Type {
+				t.Errorf("findDuplicate() of the duplicate = %q, %v, want %q, true", keyType, ok, test.key.Type)
+			}
+			if keyType, ok := findDuplicate(test.other); ok {
+				t.Errorf("findDuplicate() of another event matched %s", keyType)
+			}
+
+			// Once released, the keys of the event no longer make its duplicate one.
+			releaseDuplicateKeys(event)
+			if _, ok := findDuplicate(test.duplicate); ok {
+				t.Errorf("findDuplicate() of the duplicate matched after the keys were released")
+			}
+		})
+	}
+}
+
+// Test that the keys are only remembered for their retention.
+func TestFindDuplicateAfterRetention(t *testing.T) {
+	resetDedupe(t, DedupeKeyConfig{Type: ruleWindowDedupeKey, WindowSeconds: 60})
+
+	eventIdToTimestamp.Set(ruleWindowKeyPrefix+"rule-1", time.Now().Add(-2*time.Minute).Unix())
+	if keyType, ok := findDuplicate(&Event{EventId: "event-1", RuleId: "rule-1"}); ok {
+		t.Errorf("findDuplicate() matched %s past its retention", keyType)
+	}
+	if _, ok := findDuplicate(&Event{EventId: "event-2", RuleId: "rule-1"}); !ok {
+		t.Errorf("findDuplicate() did not match within the retention")
+	}
+}
+
+// Test that local events are only deduplicated on their event id.
+func TestFindDuplicateOfLocalEvents(t *testing.T) {
+	resetDedupe(t, DedupeKeyConfig{Type: eventIdDedupeKey}, DedupeKeyConfig{Type: ruleWindowDedupeKey})
+
+	if _, ok := findDuplicate(&Event{EventId: "local-1", RuleId: "job", local: true}); ok {
+		t.Fatalf("findDuplicate() of the first local event matched")
+	}
+	if keyType, ok := findDuplicate(&Event{EventId: "local-2", RuleId: "job", local: true}); ok {
+		t.Errorf("findDuplicate() of the next local event matched %s", keyType)
+	}
+	if _, ok := findDuplicate(&Event{EventId: "local-1", RuleId: "job", local: true}); !ok {
+		t.Errorf("findDuplicate() of the same local event did not match")
+	}
+}
+
+// Test that unknown key types fall back to deduplicating on event id.
+func TestInitializeDedupeKeysWithUnknownTypes(t *testing.T) {
+	resetDedupe(t, DedupeKeyConfig{Type: "Unknown"})
+
+	if len(dedupeKeys) != 1 || dedupeKeys[0].Type != eventIdDedupeKey {
+		t.Errorf("dedupeKeys = %v, want the event id key", dedupeKeys)
+	}
+}
+
+// Function to start a test with an empty event store and the given idempotency keys.
+func resetDedupe(t *testing.T, keys ...DedupeKeyConfig) {
+	oldKeys, oldEvents := dedupeKeys, eventIdToTimestamp
+	t.Cleanup(func() { dedupeKeys, eventIdToTimestamp = oldKeys, oldEvents })
+
+	dedupeKeys = []dedupeKey{{Type: eventIdDedupeKey, Retention: eventCleanupInterval}}
+	eventIdToTimestamp = NewConcurrentMap()
+	initializeDedupeKeys(DedupeConfig{Keys: keys})
+}
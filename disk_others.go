@@ -0,0 +1,16 @@
+// +build !windows
+
+package agent
+
+import "syscall"
+
+// Function to get the total, free and available bytes of the filesystem holding the given path. Available
+// bytes are the ones usable by unprivileged users.
+func diskUsage(path string) (uint64, uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, 0, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return stat.Blocks * blockSize, stat.Bfree * blockSize, stat.Bavail * blockSize, nil
+}
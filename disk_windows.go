@@ -0,0 +1,25 @@
+package agent
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Function to get the total, free and available bytes of the volume holding the given path. Available
+// bytes are the ones usable by the agent's user.
+func diskUsage(path string) (uint64, uint64, uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var available, total, free uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if ok == 0 {
+		return 0, 0, 0, err
+	}
+	return total, free, available, nil
+}
@@ -6,6 +6,8 @@ package agent
 import (
 	"os"
 
+	"github.com/neptuneio/agent/logging"
+
 	"gopkg.in/jmcvetta/napping.v3"
 )
 
@@ -51,7 +53,7 @@ func SetRegistrationInfo(reg *RegistrationInfo, metaData HostMetaData, nConfig N
 
 // Function to report an error happened on this agent. This function only pushes the error into a channel.
 func ReportError(err string) {
-	ErrorsChannel <- err
+	ErrorsChannel <- logging.Redact(err)
 }
 
 // Function to upload an error that happened on this agent to Neptune.io service.
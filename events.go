@@ -1,13 +1,22 @@
 // Package state contains logic to maintain an event store on Agent to remember the recently
 // processed events. This helps in avoiding the processing of duplicate events, just in case an
 // agent receives duplicate events (which shouldn't happen ideally).
+//
+// The store is crash-safe. Every record carries a checksum and is synced to disk before the event
+// is executed. Compaction writes a new file and atomically renames it over the old one, so a crash
+// at any step leaves either the old or the new complete file. Corrupted records, like a partially
+// written last line, are skipped while loading the store.
 package agent
 
 import (
 	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/neptuneio/agent/logging"
@@ -22,26 +31,48 @@ const (
 
 var eventIdToTimestamp = NewConcurrentMap()
 var eventReloadCh = time.NewTicker(eventCleanupInterval).C
-var eventPersistCh = make(chan *Event)
+var eventPersistCh = make(chan persistRequest)
 var eventsFilePath string
+var events *eventStore
 
+// Append-only file of processed event ids. Appends and compaction are serialized by the lock.
+type eventStore struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+// Request to persist the keys of an event. The result of writing them is sent on done.
+type persistRequest struct {
+	event *Event
+	done  chan error
+}
+
+// Function to persist the idempotency keys of the given event. Returns once the keys are synced to
+// disk, with the error of writing them if any.
 func PersistEvent(event *Event) error {
-	eventPersistCh <- event
-	return nil
+	done := make(chan error, 1)
+	eventPersistCh <- persistRequest{event: event, done: done}
+	return <-done
 }
 
-func InitializeEventsFile(dir string) {
+func InitializeEventsFile(dir string, config DedupeConfig) {
+	initializeDedupeKeys(config)
+
 	eventsFilePath = filepath.Join(dir, eventBackupFile)
 	logging.Info("Initializing events backup file.", logging.Fields{"filepath": eventsFilePath})
 
+	// Reload the event ids into global map.
+	store, loaded, err := openEventStore(eventsFilePath)
+	if err != nil {
+		logging.Error("Could not open the events backup file.", logging.Fields{"error": err})
+	} else {
+		events = store
+		eventIdToTimestamp = loaded
+	}
+
 	// Start a GO routine to periodically purge events from store and keep the in-memory map in sync with store.
 	go func() {
-		// Reload the event ids into global map.
-		if err := reloadEventIds(); err != nil {
-			// If there was an issue in reloading events, initialize this to empty map.
-			eventIdToTimestamp = NewConcurrentMap()
-		}
-
 		for {
 			select {
 			case <-eventReloadCh:
@@ -51,9 +82,9 @@ func InitializeEventsFile(dir string) {
 				currentTime := time.Now()
 				eventsToRemove := []string{}
 				for entry := range eventIdToTimestamp.Iter() {
-					// If the duration of event creation time to now is older than event cleanup interval,
-					// go ahead and remove the event.
-					if currentTime.Sub(time.Unix(entry.Val, 0)) > eventCleanupInterval {
+					// If the duration of event creation time to now is older than the retention of its
+					// idempotency key, go ahead and remove the event.
+					if currentTime.Sub(time.Unix(entry.Val, 0)) > dedupeRetention(entry.Key) {
 						eventsToRemove = append(eventsToRemove, entry.Key)
 					}
 				}
@@ -62,110 +93,196 @@ func InitializeEventsFile(dir string) {
 					eventIdToTimestamp.Remove(e)
 				}
 
-				// Now, write the complete map to a new file.
-				if err := os.Remove(eventsFilePath); err != nil {
-					logging.Warn("Could not remove the file.", logging.Fields{"error": err})
-				} else {
-					writeToBackupFile()
+				// Now, atomically replace the file with the remaining events.
+				if events != nil {
+					if err := events.compact(eventIdToTimestamp); err != nil {
+						logging.Warn("Could not compact the events backup file.", logging.Fields{"error": err})
+					}
 				}
-			case event := <-eventPersistCh:
+			case request := <-eventPersistCh:
+				event := request.event
 				logging.Debug("Persisting the event id.", logging.Fields{"eventId": event.EventId})
 				currentTime := time.Now().Unix()
-				eventIdToTimestamp.Set(event.EventId, currentTime)
-				writeOneRecord(event.EventId, currentTime)
+				var persistErr error
+				for _, k := range dedupeKeys {
+					key := dedupeKeyValue(k.Type, event)
+					if len(key) == 0 {
+						continue
+					}
+
+					eventIdToTimestamp.Set(key, currentTime)
+					if events != nil {
+						if err := events.append(key, currentTime); err != nil {
+							logging.Error("Could not write to event file.", logging.Fields{"error": err})
+							persistErr = err
+						}
+					}
+				}
+				request.done <- persistErr
 			}
 		}
 	}()
 }
 
-func reloadEventIds() error {
+// Function to open the event store at the given path and load the event ids from it.
+func openEventStore(path string) (*eventStore, ConcurrentMap, error) {
+	loaded := NewConcurrentMap()
 
-	var file *os.File
-	if _, err := os.Stat(eventsFilePath); os.IsNotExist(err) {
-		logging.Info("Events backup file does not exist so creating it.", logging.Fields{"file": eventsFilePath})
-		file, err = os.Create(eventsFilePath)
-		if err != nil {
-			logging.Warn("Could not create events backup file.", nil)
-			return err
-		}
-		defer file.Close()
-		return err
-	} else {
-		file, err = os.Open(eventsFilePath)
-		if err != nil {
-			logging.Warn("Could not open the backup file.", logging.Fields{"error": err})
+	// A leftover temp file means the agent crashed while compacting. If the rename didn't happen, the
+	// original file is still complete. Otherwise the temp file doesn't exist anymore. Only when there is
+	// no original file at all, the valid records of the temp file are recovered.
+	tmpPath := path + tmpFileSuffix
+	if _, err := os.Stat(tmpPath); err == nil {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			logging.Warn("Recovering events from the temp file of an interrupted compaction.", logging.Fields{"file": tmpPath})
+			if _, err := loadEventRecords(tmpPath, loaded); err != nil {
+				return nil, loaded, err
+			}
+			if err := writeEventRecords(path, loaded); err != nil {
+				return nil, loaded, err
+			}
 		}
+		os.Remove(tmpPath)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	concurrentMap := NewConcurrentMap()
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), eventIdTimestampSep)
-		if len(parts) > 1 {
-			if timestamp, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
-				concurrentMap.Set(parts[0], timestamp)
-			}
+	numCorrupted := 0
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		logging.Info("Events backup file does not exist so creating it.", logging.Fields{"file": path})
+	} else if numCorrupted, err = loadEventRecords(path, loaded); err != nil {
+		logging.Warn("Could not read text from the file.", logging.Fields{"file": path, "error": err})
+		return nil, NewConcurrentMap(), err
+	}
+
+	store := &eventStore{path: path}
+	if err := store.open(); err != nil {
+		return nil, loaded, err
+	}
+
+	// Rewrite the file if it had corrupted records so that appends don't follow a partial line.
+	if numCorrupted > 0 {
+		if err := store.compact(loaded); err != nil {
+			store.file.Close()
+			return nil, loaded, err
 		}
 	}
+	return store, loaded, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		logging.Warn("Could not read text from the file.", logging.Fields{"file": eventsFilePath})
+func (s *eventStore) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
 		return err
-	} else {
-		eventIdToTimestamp = concurrentMap
-		return nil
 	}
+	s.file = f
+	return nil
 }
 
-func writeOneRecord(eventId string, timestamp int64) {
-	// Now write the values to file.
-	f, err := os.OpenFile(eventsFilePath, os.O_APPEND|os.O_WRONLY, 0600)
-	defer f.Close()
-	if err != nil {
-		logging.Error("Could not open event file.", logging.Fields{"error": err})
-	} else {
-		writeToFile(f, eventId, timestamp)
+// Function to append a record and sync it to disk.
+func (s *eventStore) append(eventId string, timestamp int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	logging.Debug("Writing event id to file.", logging.Fields{"eventId": eventId})
+	if _, err := s.file.WriteString(eventRecord(eventId, timestamp)); err != nil {
+		return err
 	}
+	return s.file.Sync()
 }
 
-func writeToBackupFile() error {
-	if _, err := os.Stat(eventsFilePath); os.IsNotExist(err) {
-		logging.Info("Creating events backup file.", logging.Fields{"file": eventsFilePath})
-		file, err := os.Create(eventsFilePath)
-		if err != nil {
-			logging.Info("Could not create file.", nil)
-		}
-		defer file.Close()
+// Function to atomically replace the store with the given events. Appends wait until the new file is
+// in place and reopened. The file is closed meanwhile since open files can't be renamed over on
+// windows, and it's reopened even if the compaction failed.
+func (s *eventStore) compact(entries ConcurrentMap) error {
+	s.Lock()
+	defer s.Unlock()
+
+	logging.Info("Writing event ids to file.", nil)
+	s.file.Close()
+	err := writeEventRecords(s.path, entries)
+	if openErr := s.open(); err == nil {
+		err = openErr
 	}
+	return err
+}
 
-	f, err := os.OpenFile(eventsFilePath, os.O_APPEND|os.O_WRONLY, 0600)
-	defer f.Close()
+// Function to write the given events to a new file and rename it over the file at given path.
+func writeEventRecords(path string, entries ConcurrentMap) error {
+	return replaceFile(path, func(f *os.File) error {
+		w := bufio.NewWriter(f)
+		for entry := range entries.IterBuffered() {
+			if _, err := w.WriteString(eventRecord(entry.Key, entry.Val)); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	})
+}
+
+// Function to load the valid records of the file into the given map. Records with a bad checksum or
+// format are skipped. Records without checksum written by older agents are accepted. Returns the
+// number of records skipped.
+func loadEventRecords(path string, loaded ConcurrentMap) (int, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		logging.Error("Could not open event file.", logging.Fields{"error": err})
-		return err
+		return 0, err
 	}
+	defer file.Close()
 
-	logging.Info("Writing event ids to file.", nil)
+	numCorrupted := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A last line without newline was partially written when the agent crashed.
+			if len(line) > 0 {
+				numCorrupted++
+			}
+			break
+		} else if err != nil {
+			return numCorrupted, err
+		}
 
-	for entry := range eventIdToTimestamp.Iter() {
-		writeToFile(f, entry.Key, entry.Val)
+		if eventId, timestamp, ok := parseEventRecord(strings.TrimRight(line, "\r\n")); ok {
+			loaded.Set(eventId, timestamp)
+		} else if len(strings.TrimSpace(line)) > 0 {
+			numCorrupted++
+		}
 	}
 
-	return nil
+	if numCorrupted > 0 {
+		logging.Warn("Skipped corrupted records in the events backup file.", logging.Fields{"file": path, "count": numCorrupted})
+	}
+	return numCorrupted, nil
 }
 
-// Function to persist the event id to event store.
-func writeToFile(f *os.File, eventId string, timestamp int64) error {
-	logging.Debug("Writing event id to file.", logging.Fields{"eventId": eventId})
+// Function to format a record as eventId:::timestamp:::checksum with a trailing newline.
+func eventRecord(eventId string, timestamp int64) string {
+	payload := strings.Join([]string{eventId, strconv.FormatInt(timestamp, 10)}, eventIdTimestampSep)
+	return strings.Join([]string{payload, eventIdTimestampSep, eventChecksum(payload), "\n"}, "")
+}
 
-	record := strings.Join([]string{eventId, eventIdTimestampSep, strconv.FormatInt(timestamp, 10), "\n"}, "")
-	if _, err := f.WriteString(record); err != nil {
-		logging.Error("Could not write to event file.", logging.Fields{"error": err})
-		return err
+func eventChecksum(payload string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(payload)))
+}
+
+func parseEventRecord(line string) (string, int64, bool) {
+	parts := strings.Split(line, eventIdTimestampSep)
+	switch len(parts) {
+	case 2:
+		// Record written by an older agent.
+	case 3:
+		if eventChecksum(parts[0]+eventIdTimestampSep+parts[1]) != parts[2] {
+			return "", 0, false
+		}
+	default:
+		return "", 0, false
 	}
 
-	return nil
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || len(parts[0]) == 0 {
+		return "", 0, false
+	}
+	return parts[0], timestamp, true
 }
 
 // Function to check if the given event id was already processed by this agent or not.
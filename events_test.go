@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that the event store reloads the right events after a crash at every step of appending and
+// compacting.
+func TestOpenEventStoreAfterCrash(t *testing.T) {
+	oldRecords := eventRecord("old-1", 100) + eventRecord("old-2", 200)
+	newRecords := eventRecord("old-2", 200) + eventRecord("new-1", 300)
+
+	tests := []struct {
+		name string
+		// Contents of the store and of the temp file of compaction. Nil means the file doesn't exist.
+		file *string
+		tmp  *string
+		want map[string]int64
+	}{
+		{
+			name: "crash before the temp file is written",
+			file: &oldRecords,
+			want: map[string]int64{"old-1": 100, "old-2": 200},
+		},
+		{
+			name: "crash after the temp file is written but before the rename",
+			file: &oldRecords,
+			tmp:  &newRecords,
+			want: map[string]int64{"old-1": 100, "old-2": 200},
+		},
+		{
+			name: "crash after the temp file is written with no store",
+			tmp:  &newRecords,
+			want: map[string]int64{"old-2": 200, "new-1": 300},
+		},
+		{
+			name: "crash after the rename",
+			file: &newRecords,
+			want: map[string]int64{"old-2": 200, "new-1": 300},
+		},
+		{
+			name: "torn last line",
+			file: stringPtr(oldRecords + strings.TrimSuffix(eventRecord("torn", 300), "\n")[:10]),
+			want: map[string]int64{"old-1": 100, "old-2": 200},
+		},
+		{
+			name: "bad checksum",
+			file: stringPtr(eventRecord("old-1", 100) + "bad:::200:::00000000\n" + eventRecord("old-2", 200)),
+			want: map[string]int64{"old-1": 100, "old-2": 200},
+		},
+		{
+			name: "record written by an older agent",
+			file: stringPtr("legacy:::100\n"),
+			want: map[string]int64{"legacy": 100},
+		},
+		{
+			name: "no store",
+			want: map[string]int64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, eventBackupFile)
+			writeTestFile(t, path, test.file)
+			writeTestFile(t, path+tmpFileSuffix, test.tmp)
+
+			store, loaded, err := openEventStore(path)
+			if err != nil {
+				t.Fatalf("openEventStore() failed: %v", err)
+			}
+			defer store.file.Close()
+
+			got := map[string]int64{}
+			for entry := range loaded.IterBuffered() {
+				got[entry.Key] = entry.Val
+			}
+			if !equalEvents(got, test.want) {
+				t.Errorf("openEventStore() loaded %v, want %v", got, test.want)
+			}
+			if _, err := os.Stat(path + tmpFileSuffix); !os.IsNotExist(err) {
+				t.Errorf("temp file was left behind")
+			}
+
+			// Appending after the recovery must not follow a corrupted record.
+			if err := store.append("next", 400); err != nil {
+				t.Fatalf("append() failed: %v", err)
+			}
+			reloaded := NewConcurrentMap()
+			numCorrupted, err := loadEventRecords(path, reloaded)
+			if err != nil {
+				t.Fatalf("loadEventRecords() failed: %v", err)
+			}
+			if numCorrupted > 0 {
+				t.Errorf("store has %d corrupted records after the append", numCorrupted)
+			}
+			if timestamp, ok := reloaded.Get("next"); !ok || timestamp != 400 {
+				t.Errorf("appended record was not reloaded")
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content *string) {
+	if content == nil {
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(*content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equalEvents(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,268 @@
+// Package executions is responsible for keeping a record of every runbook execution on the agent
+// machine. Each execution gets its own directory holding the script, metadata, environment with the
+// secrets redacted, output and final status. This allows on-host forensics even when Neptune.io is
+// not reachable. Old records are pruned based on their age and total size.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	executionsDirName = "executions"
+
+	// By default execution records are kept for a week, up to 500MB in total.
+	defaultExecutionsMaxAgeHours    = 7 * 24
+	defaultExecutionsMaxTotalSizeMB = 500
+	executionsPruneInterval         = time.Hour
+
+	executionScriptFile      = "script"
+	executionMetadataFile    = "metadata.json"
+	executionEnvironmentFile = "environment"
+	executionStdoutFile      = "stdout"
+	executionStderrFile      = "stderr"
+	executionTranscriptFile  = "transcript.log"
+	executionStatusFile      = "status.json"
+	executionStepsFile       = "steps.json"
+)
+
+// Global variables to hold the execution records settings.
+var executionsDir string
+var executionsConfig ExecutionsConfig
+
+// Metadata of an execution written when the execution starts.
+type executionMetadata struct {
+	EventId          string `json:"eventId"`
+	RuleId           string `json:"ruleId"`
+	RuleName         string `json:"ruleName"`
+	InflightActionId string `json:"inflightActionId"`
+	ActionType       string `json:"actionType"`
+	RunbookName      string `json:"runbookName"`
+	GithubFilePath   string `json:"githubFilePath"`
+	Source           string `json:"source"`
+	Timeout          int32  `json:"timeout"`
+	EventTimestamp   int64  `json:"eventTimestamp"`
+	StartTime        int64  `json:"startTime"`
+}
+
+// Final status of an execution written when the execution finishes.
+type executionStatus struct {
+	Status     string `json:"status"`
+	StatusCode int    `json:"statusCode"`
+	IsTimeout  bool   `json:"isTimeout"`
+	EndTime    int64  `json:"endTime"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Record of a single execution. All the methods are no-op if the record directory couldn't be created.
+type executionRecord struct {
+	dir   string
+	start time.Time
+}
+
+// Function to initialize the execution records under the given directory and start a GO routine which
+// prunes the old records periodically.
+func InitializeExecutionRecords(config ExecutionsConfig, dir string) {
+	if config.MaxAgeHours <= 0 {
+		config.MaxAgeHours = defaultExecutionsMaxAgeHours
+	}
+	if config.MaxTotalSizeMB <= 0 {
+		config.MaxTotalSizeMB = defaultExecutionsMaxTotalSizeMB
+	}
+	if len(config.Dir) == 0 {
+		config.Dir = executionsDirName
+	}
+
+	executionsConfig = config
+	executionsDir = absPath(dir, config.Dir)
+	if err := os.MkdirAll(executionsDir, 0700); err != nil {
+		logging.Error("Could not create executions directory.", logging.Fields{"error": err, "dir": executionsDir})
+		executionsDir = ""
+		return
+	}
+	logging.Info("Initialized execution records.", logging.Fields{"dir": executionsDir})
+
+	go func() {
+		pruneExecutionRecords()
+		for range time.NewTicker(executionsPruneInterval).C {
+			pruneExecutionRecords()
+		}
+	}()
+}
+
+// Function to get the directory holding the record of the given event's execution. Events without a
+// usable id get no record since it would land in the records directory itself.
+func executionRecordDir(event *Event) string {
+	if len(executionsDir) == 0 {
+		return ""
+	}
+	id := safeFileName(executionId(event))
+	if len(strings.Trim(id, ".")) == 0 {
+		logging.Warn("Not recording the execution of the event without an id.", logging.Fields{"id": id})
+		return ""
+	}
+	return filepath.Join(executionsDir, id)
+}
+
+// Helper function to make sure that an id can be used as a file name.
+func safeFileName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(name)
+}
+
+// Function to start the record of an execution. The values of the secret environment variables are
+// never written and all the other values are redacted. The script is left out if there is none, like
+// for native and plugin actions.
+func newExecutionRecord(event *Event, script, scriptExt string, env map[string]string, secrets map[string]string) *executionRecord {
+	r := &executionRecord{dir: executionRecordDir(event), start: time.Now()}
+	if len(r.dir) == 0 {
+		return r
+	}
+
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		logging.Warn("Could not create execution record directory.", logging.Fields{"error": err, "dir": r.dir})
+		r.dir = ""
+		return r
+	}
+
+	if len(script) > 0 {
+		r.writeFile(executionScriptFile+scriptExt, script)
+	}
+	r.writeJSON(executionMetadataFile, executionMetadata{
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		RuleName:         event.RuleName,
+		InflightActionId: event.InflightActionId,
+		ActionType:       event.ActionType,
+		RunbookName:      event.RunbookName,
+		GithubFilePath:   event.GithubFilePath,
+		Source:           event.Source,
+		Timeout:          event.Timeout,
+		EventTimestamp:   event.Timestamp,
+		StartTime:        r.start.UnixNano() / 1000000,
+	})
+
+	lines := []string{}
+	for _, vars := range []map[string]string{event.Environment, env} {
+		for k, v := range vars {
+			if _, ok := secrets[k]; ok {
+				v = logging.RedactedText
+			}
+			lines = append(lines, fmt.Sprintf("%s=%s", k, logging.Redact(v)))
+		}
+	}
+	sort.Strings(lines)
+	r.writeFile(executionEnvironmentFile, strings.Join(lines, "\n")+"\n")
+
+	return r
+}
+
+// Function to record an execution which ran no script, like an event rejected before running.
+func recordWithoutScript(event *Event, result commandResult) {
+	newExecutionRecord(event, "", "", nil, nil).finish(result)
+}
+
+// Function to write the output and final status of the execution.
+func (r *executionRecord) finish(result commandResult) {
+	if len(r.dir) == 0 {
+		return
+	}
+
+	end := time.Now()
+	r.writeFile(executionStdoutFile, logging.Redact(result.Stdout))
+	r.writeFile(executionStderrFile, logging.Redact(result.Stderr))
+	r.writeJSON(executionStatusFile, executionStatus{
+		Status:     result.Status,
+		StatusCode: result.StatusCode,
+		IsTimeout:  result.Timeout,
+		EndTime:    end.UnixNano() / 1000000,
+		DurationMs: int64(end.Sub(r.start) / time.Millisecond),
+	})
+	if len(result.Steps) > 0 {
+		r.writeJSON(executionStepsFile, result.Steps)
+	}
+}
+
+func (r *executionRecord) writeFile(name, content string) {
+	path := filepath.Join(r.dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		logging.Warn("Could not write execution record file.", logging.Fields{"error": err, "file": path})
+	}
+}
+
+func (r *executionRecord) writeJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logging.Warn("Could not serialize execution record.", logging.Fields{"error": err, "file": name})
+		return
+	}
+	r.writeFile(name, string(data)+"\n")
+}
+
+// Function to remove the execution records older than the maximum age and then the oldest ones until
+// the total size is within the limit.
+func pruneExecutionRecords() {
+	entries, err := ioutil.ReadDir(executionsDir)
+	if err != nil {
+		logging.Warn("Could not list execution records.", logging.Fields{"error": err})
+		return
+	}
+
+	type record struct {
+		path    string
+		modTime time.Time
+		size    int64
+	}
+
+	records := []record{}
+	var totalSize int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		r := record{path: filepath.Join(executionsDir, entry.Name()), modTime: entry.ModTime()}
+		filepath.Walk(r.path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil {
+				r.size += info.Size()
+				if info.ModTime().After(r.modTime) {
+					r.modTime = info.ModTime()
+				}
+			}
+			return nil
+		})
+		records = append(records, r)
+		totalSize += r.size
+	}
+
+	// Oldest first.
+	sort.Slice(records, func(i, j int) bool { return records[i].modTime.Before(records[j].modTime) })
+
+	maxAge := time.Duration(executionsConfig.MaxAgeHours) * time.Hour
+	maxTotalSize := int64(executionsConfig.MaxTotalSizeMB) * 1024 * 1024
+	numRemoved := 0
+	for _, r := range records {
+		if time.Since(r.modTime) <= maxAge && totalSize <= maxTotalSize {
+			break
+		}
+
+		if err := os.RemoveAll(r.path); err != nil {
+			logging.Warn("Could not remove execution record.", logging.Fields{"error": err, "dir": r.path})
+			continue
+		}
+		totalSize -= r.size
+		numRemoved++
+	}
+
+	if numRemoved > 0 {
+		logging.Info("Pruned old execution records.", logging.Fields{"count": numRemoved})
+	}
+}
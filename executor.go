@@ -24,9 +24,7 @@ import (
 )
 
 const (
-	// Currently we truncate the runbook execution output to 2MB.
-	maxActionOutputSize = 2 * 1024 * 1024 // 10MB
-	filePathSeparator   = "/"
+	filePathSeparator = "/"
 
 	// All the events/SQS messages older than 10min are discarded as stale.
 	stalenessTimeout = 10 * 60 * 1000
@@ -116,9 +114,45 @@ func writeToTmpFile(eventId, runbookName string, rawCmd *string) (string, error)
 	return fileName, nil
 }
 
-func sendActionOutput(regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage,
-	event *Event, stdout, stderr string, status string, statusCode int, timeout bool) error {
-	actionOutputs <- &ActionOutputMessage{
+// Result of running a runbook command.
+type commandResult struct {
+	Status     string
+	StatusCode int
+	Timeout    bool
+	Stdout     string
+	Stderr     string
+	Transcript string
+
+	// Results of the steps if the runbook is a manifest.
+	Steps []StepResult
+
+	// Attempt number of the execution as per the retry policy.
+	Attempt int
+
+	// Result of the rollback runbook if the execution failed and had one.
+	Rollback *StepResult
+
+	// Results of the health checks around the runbook.
+	Checks []CheckResult
+
+	// Time spent waiting for the locks of the runbook.
+	LockWaitMs int64
+
+	// Structured result of a native action.
+	Result *ActionResult
+}
+
+// Function to construct the action output message reporting the runbook execution for given event.
+func newActionOutputMessage(regInfo *RegistrationInfo, event *Event, result commandResult) *ActionOutputMessage {
+	// The outputs of a manifest are reported by its steps, so the combined output is left out.
+	stdout, stderr := result.Stdout, result.Stderr
+	if len(result.Steps) > 0 {
+		stdout, stderr = stepsSummary(result.Steps)
+	}
+	actionOutput := encodeOutput(stdout, maxOutputSize())
+	failureReason := encodeOutput(stderr, maxOutputSize())
+
+	output := &ActionOutputMessage{
 		RuleName:         event.RuleName,
 		RuleId:           event.RuleId,
 		HostName:         event.Hostname,
@@ -126,22 +160,96 @@ func sendActionOutput(regInfo *RegistrationInfo, actionOutputs chan<- *ActionOut
 		InflightActionId: event.InflightActionId,
 		ActionType:       event.ActionType,
 		AgentId:          regInfo.AgentId,
-		StatusCode:       statusCode,
-		Status:           status,
-		IsTimeout:        timeout,
-		ActionOutput:     stdout,
-		FailureReason:    stderr,
+		StatusCode:       result.StatusCode,
+		Status:           result.Status,
+		IsTimeout:        result.Timeout,
+		ActionOutput:     actionOutput.Text,
+		FailureReason:    failureReason.Text,
+
+		ActionOutputEncoding:   actionOutput.Encoding,
+		ActionOutputSize:       actionOutput.Size,
+		ActionOutputTruncated:  actionOutput.Truncated,
+		FailureReasonEncoding:  failureReason.Encoding,
+		FailureReasonSize:      failureReason.Size,
+		FailureReasonTruncated: failureReason.Truncated,
+		Steps:                  result.Steps,
+		Attempt:                result.Attempt,
+		Rollback:               result.Rollback,
+		Checks:                 result.Checks,
+		LockWaitMs:             result.LockWaitMs,
+		Result:                 result.Result,
+		trace:                  event.trace,
 	}
 
-	logging.Info("Finished processing the event.", logging.Fields{"eventId": event.EventId,
-		"status":   status,
-		"exitCode": statusCode,
-		"timeout":  timeout})
+	if len(result.Transcript) > 0 {
+		transcript := encodeOutput(result.Transcript, maxOutputSize())
+		output.Transcript = transcript.Text
+		output.TranscriptEncoding = transcript.Encoding
+		output.TranscriptTruncated = transcript.Truncated
+	}
+	return output
+}
+
+func sendActionOutput(actionOutputs chan<- *ActionOutputMessage, output *ActionOutputMessage) error {
+	actionOutputs <- output
+
+	logging.Info("Finished processing the event.", logging.Fields{"eventId": output.EventId,
+		"status":   output.Status,
+		"exitCode": output.StatusCode,
+		"timeout":  output.IsTimeout})
 	return nil
 }
 
-// Function to execute the runbook in the given temp file.
-func execute(regInfo *RegistrationInfo, event *Event, tmpFile string, hasShebang bool) (string, int, bool, string, string) {
+// Function to execute the runbook in the given temp file. The extra environment variables
+// are set in addition to the ones in the event.
+func execute(regInfo *RegistrationInfo, event *Event, tmpFile string, hasShebang bool, extraEnv map[string]string) commandResult {
+	cmd := scriptCommand(tmpFile, hasShebang)
+	cmd.Env = commandEnv(event, extraEnv)
+
+	// Optionally record the interleaved stdout and stderr lines in a combined transcript.
+	var t *transcript
+	if outputConfig.CombinedTranscript {
+		t = newTranscript(event)
+	}
+
+	result := runCommand(cmd, time.Second*time.Duration(event.Timeout), t, "", actionStarted(regInfo, event))
+	if t != nil {
+		result.Transcript = t.finish()
+	}
+	return result
+}
+
+// Function to report the given event as failed without running it, for a reason which a redelivery
+// won't fix, like an invalid runbook. The event is persisted and its SQS message deleted so that it
+// isn't run again, and the failure is recorded like any other execution.
+func failEvent(regInfo *RegistrationInfo, event *Event, actionOutputs chan<- *ActionOutputMessage, reason string) error {
+	logging.Error("Not running the event.", logging.Fields{"eventId": event.EventId, "reason": reason})
+	if err := PersistEvent(event); err != nil {
+		logging.Error("Could not persist the event.", logging.Fields{"error": err})
+	}
+	DeleteMessage(regInfo, &event.ReceiptHandle)
+
+	result := commandResult{Status: "FAILED", StatusCode: 1, Stderr: reason, Attempt: 1}
+	recordWithoutScript(event, result)
+	recordExecution(event, time.Now(), result)
+	recordBreakerResult(event.RuleId, true)
+	return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+}
+
+// Function to get the callback run once the command of the given event has started.
+func actionStarted(regInfo *RegistrationInfo, event *Event) func(pid int) func() {
+	return func(pid int) func() {
+		// Immediately delete the SQS message since the command has started.
+		DeleteMessage(regInfo, &event.ReceiptHandle)
+		if pid > 0 {
+			return recordSpawned(event, pid)
+		}
+		return nil
+	}
+}
+
+// Function to build the command which runs the script in the given temp file.
+func scriptCommand(tmpFile string, hasShebang bool) *exec.Cmd {
 	var cmd *exec.Cmd
 	if runtime.GOOS == "windows" {
 		if strings.HasSuffix(tmpFile, ".ps1") {
@@ -158,32 +266,58 @@ func execute(regInfo *RegistrationInfo, event *Event, tmpFile string, hasShebang
 			cmd = exec.Command("/bin/sh", "-c", tmpFile)
 		}
 	}
+	return cmd
+}
+
+// Function to get the environment of the runbook process. Returns nil, which means the agent's own
+// environment, if neither the event nor the agent set any variables.
+func commandEnv(event *Event, extraEnv map[string]string) []string {
+	if event.Environment == nil && len(extraEnv) == 0 {
+		return nil
+	}
 
+	env := os.Environ()
+	for k, v := range event.Environment {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	for k, v := range extraEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
+
+// Function to run the given command and kill it along with its children if it doesn't finish within
+// the timeout. The output is also added to the transcript, if any, under streams with the given prefix.
+// The started function is called right after starting the command with its pid, or 0 if it couldn't start.
+// The function it returns, if any, is called once the command has exited.
+func runCommand(cmd *exec.Cmd, timeout time.Duration, t *transcript, streamPrefix string, started func(pid int) func()) commandResult {
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	if t != nil {
+		cmd.Stdout = t.writer(streamPrefix+stdoutStream, &stdout)
+		cmd.Stderr = t.writer(streamPrefix+stderrStream, &stderr)
+	}
 
 	SetPGroup(cmd)
 
-	// Set the environment variables.
-	if event.Environment != nil {
-		env := os.Environ()
-		for k, v := range event.Environment {
-			env = append(env, fmt.Sprintf("%s=%s", k, v))
-		}
-		cmd.Env = env
-	}
-
 	status := "SUCCESS"
-	timeout := false
+	timedOut := false
 	statusCode := 1
 	var waitStatus syscall.WaitStatus
 
 	// Start the command first.
 	exitError := cmd.Start()
 
-	// Immediately delete the SQS message since the command has started.
-	DeleteMessage(regInfo, &event.ReceiptHandle)
+	pid := 0
+	if exitError == nil {
+		pid = cmd.Process.Pid
+	}
+	if started != nil {
+		if exited := started(pid); exited != nil {
+			defer exited()
+		}
+	}
 
 	if exitError != nil {
 		logging.Error("Could not start the command.", logging.Fields{"error": exitError})
@@ -195,23 +329,23 @@ func execute(regInfo *RegistrationInfo, event *Event, tmpFile string, hasShebang
 
 		// Start a timer to kill the command after given timeout.
 		select {
-		case <-time.After(time.Second * time.Duration(event.Timeout)):
-			logging.Debug("Killing the command.", logging.Fields{"eventId": event.EventId})
+		case <-time.After(timeout):
+			logging.Debug("Killing the command.", logging.Fields{"pid": pid})
 
 			// Kill the command and all its children.
 			KillCommand(cmd)
 
 			exitError = <-done // allow goroutine to exit
-			timeout = true
+			timedOut = true
 			status = "TIMEOUT"
-			logging.Info("Killed the command after timeout.", logging.Fields{"error": exitError, "eventId": event.EventId})
+			logging.Info("Killed the command after timeout.", logging.Fields{"error": exitError, "pid": pid})
 
 		case exitError = <-done:
 		}
 	}
 
 	if exitError != nil {
-		logging.Error("Failed to run the command.", logging.Fields{"error": exitError, "cmdFile": tmpFile})
+		logging.Error("Failed to run the command.", logging.Fields{"error": exitError, "cmd": cmd.Args})
 
 		status = "FAILED"
 
@@ -228,33 +362,70 @@ func execute(regInfo *RegistrationInfo, event *Event, tmpFile string, hasShebang
 		statusCode = waitStatus.ExitStatus()
 	}
 
-	return status, statusCode, timeout, stdout.String(), stderr.String()
+	return commandResult{
+		Status:     status,
+		StatusCode: statusCode,
+		Timeout:    timedOut,
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+	}
 }
 
 // Main function to execute runbook based on the given event.
 //
 // This function does following checks before executing the runbook.
-// 1. Using persistent event store, it verifies that the newly received event is not a duplicate.
+// 1. Using persistent event store, it verifies that the newly received event is not a duplicate
+//    based on the configured idempotency keys.
 // 2. Based on the timestamp on event, it checks if the event is not too old.
 // 3. If the agent is configured to execute only Github runbooks, it double checks that the event contains
-//    Github runbook link and agent configuration has the Github access key.
+//    Github runbook link and agent configuration has the Github access key. Local events created by the
+//    agent itself are trusted since their runbooks come from the agent config.
 // The event will be discarded and SQS message will be deleted if any of the above checks fail.
-func ExecuteAction(event *Event, regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, githubKey string) error {
+// Events received during a blackout are then either released back to SQS or rejected, as per policy,
+// and events of a rule whose circuit breaker is open are suppressed. Events of a native action type are
+// handled by the agent itself and the ones of a plugin action type by the plugin. The others are
+// rejected if shell scripts are disabled.
+func ExecuteAction(event *Event, regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, githubKey string) (err error) {
+	// Trace the handling of the event under the SQS receive, which the action output is also reported under.
+	span := startSpan("ExecuteAction", spanKindInternal, event.trace)
+	span.setAttribute("neptune.event_id", event.EventId)
+	span.setAttribute("neptune.rule_id", event.RuleId)
+	span.setAttribute("neptune.action_type", event.ActionType)
+	if span != nil {
+		event.trace = span.context()
+	}
+	defer func() {
+		span.setError(err)
+		span.finish()
+	}()
 
 	// Check if this event was already processed. This guards against duplicate events, just in case.
-	if HasProcessedEvent(event.EventId) {
-		logging.Info("Discarding the event since it was already processed.", logging.Fields{"eventId": event.EventId})
+	if keyType, ok := findDuplicate(event); ok {
+		logging.Info("Discarding the event since it was already processed.", logging.Fields{"eventId": event.EventId, "key": keyType})
+		recordDuplicate(event, keyType)
+		countRejected(rejectedDuplicate)
 
 		// Delete this event from SQS.
 		DeleteMessage(regInfo, &event.ReceiptHandle)
 		return nil
 	}
 
+	// The keys of the event are now reserved. Release them unless the action is run or if the event is left
+	// in SQS to be redelivered, which is the case when it fails with an error. Otherwise a dropped event
+	// would make the next event of its rule a duplicate.
+	accepted := false
+	defer func() {
+		if err != nil || !accepted {
+			releaseDuplicateKeys(event)
+		}
+	}()
+
 	// Check if the event is stale and discard it if so.
 	currentMillis := time.Now().UnixNano() / 1000000
 	if currentMillis-event.Timestamp > stalenessTimeout {
 		logging.Error("Received a stale event. Dropping and deleting it from SQS.",
 			logging.Fields{"eventId": event.EventId, "timestamp": event.Timestamp})
+		countRejected(rejectedStale)
 
 		// Delete this event from SQS.
 		DeleteMessage(regInfo, &event.ReceiptHandle)
@@ -262,18 +433,86 @@ func ExecuteAction(event *Event, regInfo *RegistrationInfo, actionOutputs chan<-
 	}
 
 	// Check if this agent is configured to run only Github runbooks. If so, discard any other
-	// event containing Neptune runbook.
-	if len(githubKey) > 0 && len(event.RawCommand) > 0 {
+	// event containing Neptune runbook. The policy is about the runbooks sent by Neptune.io, so local
+	// events are exempt: their inline runbooks come from the agent config on the host itself.
+	if len(githubKey) > 0 && len(event.RawCommand) > 0 && !event.local {
 		logging.Error("Agent is configured to run Github runbooks only but received Neptune runbook."+
 			" Dropping and deleting the event.", logging.Fields{"eventId": event.EventId})
+		countRejected(rejectedGithubOnly)
+
 		// Delete this event from SQS.
 		DeleteMessage(regInfo, &event.ReceiptHandle)
 		return nil
 	}
 
+	// Check if the agent is in a blackout, in which case the event is deferred or rejected as per policy.
+	if blackout := CurrentBlackout(); blackout.Active {
+		if blackout.Policy == blackoutPolicyReject {
+			logging.Info("Rejecting the event during blackout.", logging.Fields{"eventId": event.EventId, "blackout": blackout.Source})
+			DeleteMessage(regInfo, &event.ReceiptHandle)
+
+			now := time.Now()
+			result := commandResult{Status: blackoutStatus, StatusCode: 1, Attempt: 1,
+				Stderr: "Agent is in a blackout (" + blackout.Source + "), so the runbook was not run. " + blackout.Reason}
+			recordWithoutScript(event, result)
+			recordExecution(event, now, result)
+			return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+		}
+
+		if event.local {
+			logging.Info("Skipping the local event during blackout.", logging.Fields{"eventId": event.EventId, "blackout": blackout.Source})
+			return nil
+		}
+
+		delay := blackoutDeferDelay(blackout)
+		logging.Info("Deferring the event during blackout.", logging.Fields{"eventId": event.EventId, "blackout": blackout.Source, "delay": delay})
+		countReleased(releasedBlackout)
+		return ReleaseMessage(regInfo, &event.ReceiptHandle, delay)
+	}
+
+	// Check if the rule is flapping, in which case its events are suppressed until its breaker closes.
+	if reason, open := isBreakerOpen(event.RuleId); open {
+		logging.Warn("Suppressing the event since the circuit breaker of the rule is open.", logging.Fields{"eventId": event.EventId, "ruleId": event.RuleId})
+		DeleteMessage(regInfo, &event.ReceiptHandle)
+
+		result := commandResult{Status: suppressedStatus, StatusCode: 1, Attempt: 1,
+			Stderr: "Circuit breaker of the rule is open, so the runbook was not run. " + reason}
+		recordWithoutScript(event, result)
+		recordExecution(event, time.Now(), result)
+		return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+	}
+
+	// Track the execution so that it can be listed and cancelled through the control API.
+	defer startInflight(event)()
+
+	// Native actions are implemented by the agent itself and need no runbook.
+	if isNativeAction(event.ActionType) {
+		accepted = true
+		return executeNativeAction(regInfo, event, actionOutputs)
+	}
+
+	// Action types added by plugins are handled by the plugins.
+	if isPluginAction(event.ActionType) {
+		accepted = true
+		return executePluginAction(regInfo, event, actionOutputs)
+	}
+
+	// Check if shell scripts are disabled by policy, in which case only native and plugin actions can run.
+	if nativeConfig.DisableScripts {
+		logging.Warn("Not running the runbook since shell scripts are disabled.", logging.Fields{"eventId": event.EventId})
+		DeleteMessage(regInfo, &event.ReceiptHandle)
+
+		result := commandResult{Status: "FAILED", StatusCode: 1, Attempt: 1,
+			Stderr: "Shell scripts are disabled on this agent, so the runbook was not run."}
+		recordWithoutScript(event, result)
+		recordExecution(event, time.Now(), result)
+		return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+	}
+	accepted = true
+
 	// All good to go. Process the event further.
 	logging.Info("Processing event.", logging.Fields{"eventId": event.EventId})
-	logging.Debug("Event data..", logging.Fields{"event": event})
+	logging.Debug("Event data..", logging.Fields{"event": event.loggable()})
 
 	var runbookContent *string
 	if len(event.GithubFilePath) > 0 {
@@ -281,7 +520,11 @@ func ExecuteAction(event *Event, regInfo *RegistrationInfo, actionOutputs chan<-
 			logging.Error("Github api key or file path is empty.", nil)
 			return errors.New("Empty Github api key.")
 		} else {
+			fetch := startSpan("runbook.fetch", spanKindClient, event.trace)
+			fetch.setAttribute("neptune.runbook_path", event.GithubFilePath)
 			content, err := getRunbookFromGithub(githubKey, event.GithubFilePath)
+			fetch.setError(err)
+			fetch.finish()
 			if err != nil {
 				return err
 			} else {
@@ -292,30 +535,195 @@ func ExecuteAction(event *Event, regInfo *RegistrationInfo, actionOutputs chan<-
 		runbookContent = &event.RawCommand
 	}
 
-	tmpFile, e := writeToTmpFile(event.EventId, event.RunbookName, runbookContent)
+	// Resolve the secrets referenced by the event from local secret providers. The values are only
+	// injected into the runbook environment and are never logged.
+	secrets, e := resolveSecrets(event.Secrets)
+	if e != nil {
+		return failEvent(regInfo, event, actionOutputs, e.Error())
+	}
+
+	// A runbook can also be a manifest of steps. An invalid manifest or health check is reported as
+	// failed right away since running it again won't help.
+	manifest, e := parseRunbookManifest(*runbookContent)
+	var preChecks, postChecks []HealthCheck
+	var locks []LockSpec
+	if e == nil {
+		preChecks, e = healthChecksFor(event, manifest, preCheckPhase, githubKey)
+	}
+	if e == nil {
+		locks, e = locksFor(event, manifest)
+	}
+	if e == nil {
+		postChecks, e = healthChecksFor(event, manifest, postCheckPhase, githubKey)
+	}
 	if e != nil {
-		return errors.New("Could not write the commands to a file.")
+		return failEvent(regInfo, event, actionOutputs, "Invalid runbook: "+e.Error())
+	}
+
+	var tmpFile string
+	var stepScripts map[string]string
+	scriptExt := manifestExtension
+	if manifest != nil {
+		if stepScripts, e = loadStepScripts(manifest, githubKey); e != nil {
+			return e
+		}
+	} else {
+		write := startSpan("writeToTmpFile", spanKindInternal, event.trace)
+		tmpFile, e = writeToTmpFile(event.EventId, event.RunbookName, runbookContent)
+		write.setError(e)
+		write.finish()
+		if e != nil {
+			return errors.New("Could not write the commands to a file.")
+		}
+		defer os.Remove(tmpFile)
+		scriptExt = filepath.Ext(tmpFile)
 	}
-	defer os.Remove(tmpFile)
 
 	// Persist the event so that we don't rerun the action for this event again.
 	if err := PersistEvent(event); err != nil {
 		logging.Error("Could not persist the event.", logging.Fields{"error": err})
 	}
 
-	// Execute the command and delete the SQS message after starting the command successfully.
-	status, code, timeout, stdout, stderr := execute(regInfo, event, tmpFile, strings.HasPrefix(*runbookContent, shebangPrefix))
+	// Let the runbook write a structured result and leave artifacts in addition to its output.
+	env := map[string]string{resultFileEnvVar: resultFilePath(event.EventId)}
+	for k, v := range secrets {
+		env[k] = v
+	}
 
-	// Truncate the stderr and stdout to a maximum value.
-	if len(stdout) > maxActionOutputSize {
-		stdout = stdout[:maxActionOutputSize-1]
+	record := newExecutionRecord(event, *runbookContent, scriptExt, env, secrets)
+
+	// Wait for the locks of the runbook so that conflicting runbooks don't run at the same time. The SQS
+	// message is kept hidden meanwhile, and the event was persisted so a redelivery is discarded anyway.
+	var lockWaitMs int64
+	if len(locks) > 0 {
+		SetMessageVisibility(regInfo, &event.ReceiptHandle, maxLockWait(locks)+time.Duration(event.Timeout+2)*time.Second)
+
+		start := time.Now()
+		held, err := acquireLocks(event.EventId, locks)
+		lockWaitMs = int64(time.Since(start) / time.Millisecond)
+		if err != nil {
+			logging.Warn("Not running the runbook since its locks couldn't be taken.", logging.Fields{"eventId": event.EventId, "error": err})
+			DeleteMessage(regInfo, &event.ReceiptHandle)
+
+			result := commandResult{Status: lockTimeoutStatus, StatusCode: 1, Stderr: err.Error(), Attempt: 1, LockWaitMs: lockWaitMs}
+			record.finish(result)
+			recordExecution(event, start, result)
+			return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+		}
+		defer held.release()
+		logging.Info("Took the runbook locks.", logging.Fields{"eventId": event.EventId, "waitMs": lockWaitMs})
 	}
 
-	if len(stderr) > maxActionOutputSize {
-		stderr = stderr[:maxActionOutputSize-1]
+	// Run the pre-checks, which decide whether the runbook runs at all.
+	var preResults []CheckResult
+	if len(preChecks) > 0 {
+		start := time.Now()
+		results, passed := runHealthChecks(event, preChecks, preCheckPhase, env)
+		if !passed {
+			logging.Info("Not running the runbook since a pre-check failed.", logging.Fields{"eventId": event.EventId})
+			DeleteMessage(regInfo, &event.ReceiptHandle)
+
+			result := commandResult{Status: precheckFailedStatus, StatusCode: 1, Stderr: failedChecksReason(results), Checks: results, Attempt: 1, LockWaitMs: lockWaitMs}
+			record.finish(result)
+			recordExecution(event, start, result)
+			return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+		}
+		preResults = results
+	}
+
+	// Journal the start so that the execution is reported even if the agent dies while it runs.
+	recordStarted(event)
+
+	// Run the runbook until it succeeds or its retry policy gives up. Every attempt is reported.
+	policy := retryPolicyFor(event)
+	current := event
+	for attempt := 1; ; attempt++ {
+		env[attemptEnvVar] = fmt.Sprint(attempt)
+		delete(env, artifactsDirEnvVar)
+		if dir, err := createArtifactsDir(event.EventId, attempt); err == nil {
+			env[artifactsDirEnvVar] = dir
+		}
+
+		// Trace every attempt, and let the runbook join the trace through its environment.
+		run := startSpan("execute", spanKindInternal, event.trace)
+		run.setAttribute("neptune.attempt", fmt.Sprint(attempt))
+		addTraceEnv(env, run)
+
+		// Execute the command and delete the SQS message after starting the command successfully.
+		start := time.Now()
+		var result commandResult
+		if manifest != nil {
+			result = runManifest(regInfo, current, manifest, stepScripts, env)
+		} else {
+			result = execute(regInfo, current, tmpFile, strings.HasPrefix(*runbookContent, shebangPrefix), env)
+		}
+		result.Attempt = attempt
+		result.LockWaitMs = lockWaitMs
+		cancelled := isCancelled(event.EventId)
+		if cancelled {
+			markCancelled(&result)
+		}
+		run.setAttribute("neptune.status", result.Status)
+		run.setAttribute("process.exit_code", fmt.Sprint(result.StatusCode))
+		if result.Status != "SUCCESS" {
+			run.setError(errors.New("Runbook finished with status " + result.Status + "."))
+		}
+		run.finish()
+
+		// Run the post-checks, which decide whether the remediation actually worked.
+		result.Checks = append([]CheckResult{}, preResults...)
+		if result.Status == "SUCCESS" && len(postChecks) > 0 {
+			results, passed := runHealthChecks(current, postChecks, postCheckPhase, env)
+			result.Checks = append(result.Checks, results...)
+			if !passed {
+				result.Status = "FAILED"
+				if len(result.Stderr) > 0 && !strings.HasSuffix(result.Stderr, "\n") {
+					result.Stderr += "\n"
+				}
+				result.Stderr += failedChecksReason(results)
+			}
+		}
+
+		retry := !cancelled && attempt < policy.maxAttempts() && policy.shouldRetry(result) && takeRetryBudget(event.RuleId)
+
+		// Roll back once the runbook has failed for good, unless it was cancelled.
+		if ref := rollbackFor(event, manifest); !retry && !cancelled && result.Status != "SUCCESS" && ref != nil {
+			result.Rollback = runRollback(current, ref, githubKey, env, result)
+		}
+
+		if retry {
+			recordAttempt(event, start, result)
+		} else {
+			record.finish(result)
+			recordExecution(event, start, result)
+			recordBreakerResult(event.RuleId, result.Status != "SUCCESS")
+		}
+
+		output := newActionOutputMessage(regInfo, event, result)
+		output.WillRetry = retry
+		attachActionResult(output, env[resultFileEnvVar])
+		if dir, ok := env[artifactsDirEnvVar]; ok {
+			artifacts, accepted := collectArtifacts(dir)
+			output.Artifacts = append([]ArtifactInfo{}, artifacts...)
+			output.ArtifactsPending = len(accepted) > 0
+			go uploadArtifacts(regInfo, event, attempt, dir, artifacts, accepted)
+		}
+
+		e = sendActionOutput(actionOutputs, output)
+		if !retry {
+			break
+		}
+
+		delay := policy.delay(attempt)
+		logging.Info("Retrying the failed runbook.", logging.Fields{"eventId": event.EventId, "attempt": attempt + 1, "delay": delay})
+		time.Sleep(delay)
+
+		// The SQS message was deleted when the first attempt started.
+		retryEvent := *event
+		retryEvent.ReceiptHandle = ""
+		current = &retryEvent
 	}
 
-	e = sendActionOutput(regInfo, actionOutputs, event, stdout, stderr, status, code, timeout)
 	if e != nil {
 		logging.Error("Could not queue the action output for Neptune", logging.Fields{"error": e})
 	} else {
@@ -0,0 +1,17 @@
+package agent
+
+import (
+	"os"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+// Host-wide lock files aren't supported on windows, so only the locks within the agent apply.
+func tryLockFile(path string, exclusive bool) (*os.File, error) {
+	logging.Debug("Host-wide lock files are not supported on windows.", logging.Fields{"file": path})
+	return nil, errHostLocksUnsupported
+}
+
+func unlockFile(f *os.File) {
+	f.Close()
+}
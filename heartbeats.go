@@ -14,12 +14,15 @@ import (
 
 // Message sent by Agent to Neptune.io service as a heartbeat.
 type Heartbeat struct {
-	Status string
+	Status   string
+	Blackout BlackoutStatus
 }
 
 // Function to send a heartbeat to Neptune.io service.
-func Beat(configObj *NeptuneConfig, agentId string) error {
-	request := Heartbeat{Status: CurrentStatus().String()}
+func Beat(configObj *NeptuneConfig, agentId string) (err error) {
+	defer func() { heartbeats.inc(outcome(err)) }()
+
+	request := Heartbeat{Status: CurrentStatus().String(), Blackout: CurrentBlackout()}
 	response := Response{}
 
 	logging.Debug("Sending heartbeat to Neptune.", logging.Fields{"request": request})
@@ -0,0 +1,527 @@
+// Package history contains the local execution history store of the agent. The store is an
+// append-only file of JSON records along with an in-memory index of record offsets, which is
+// rebuilt when the agent starts. Local tooling and the agent's status endpoints use the query
+// API to list and filter the executions.
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	historyFileName = ".history"
+
+	// By default the history is kept for 30 days, up to 50MB.
+	defaultHistoryMaxSizeMB     = 50
+	defaultHistoryRetentionDays = 30
+	defaultHistoryQueryLimit    = 100
+	historyRetentionInterval    = time.Hour
+
+	// Kinds of history records. Queries return executions unless they ask for another kind or all of them.
+	executionHistoryKind = "execution"
+	allHistoryKinds      = "all"
+)
+
+var errHistoryClosed = errors.New("History store is closed.")
+
+// A single record in the execution history. Times are in milliseconds since epoch.
+type HistoryRecord struct {
+	Kind             string `json:"kind"`
+	EventId          string `json:"eventId"`
+	RuleId           string `json:"ruleId"`
+	InflightActionId string `json:"inflightActionId"`
+	StartTime        int64  `json:"startTime"`
+	EndTime          int64  `json:"endTime"`
+	Status           string `json:"status"`
+	ExitCode         int    `json:"exitCode"`
+	OutputDigest     string `json:"outputDigest"`
+	DedupeKey        string `json:"dedupeKey,omitempty"`
+	RuleName         string `json:"ruleName,omitempty"`
+	ActionType       string `json:"actionType,omitempty"`
+	Timeout          int32  `json:"timeout,omitempty"`
+	Pid              int    `json:"pid,omitempty"`
+	ProcessStart     string `json:"processStart,omitempty"`
+	BootId           string `json:"bootId,omitempty"`
+	Attempt          int    `json:"attempt,omitempty"`
+}
+
+// Filter used to query the execution history. Empty fields match everything, except Kind which matches
+// executions only when empty. The other kinds are journal records used by the agent itself.
+type HistoryFilter struct {
+	Kind             string
+	EventId          string
+	RuleId           string
+	InflightActionId string
+	Status           string
+	Since            int64
+	Until            int64
+	Limit            int
+}
+
+// Location of a record in the history file.
+type historyEntry struct {
+	offset int64
+	length int
+}
+
+// Append-only history store with indexes on event id, rule id and inflight action id.
+type historyStore struct {
+	sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	retention  time.Duration
+	entries    []historyEntry
+	byEventId  map[string][]int
+	byRuleId   map[string][]int
+	byInflight map[string][]int
+}
+
+// Global variable to hold the history store of this agent.
+var history *historyStore
+
+// Function to open the execution history store in the given directory.
+func InitializeHistory(config HistoryConfig, dir string) {
+	if config.MaxSizeMB <= 0 {
+		config.MaxSizeMB = defaultHistoryMaxSizeMB
+	}
+	if config.RetentionDays <= 0 {
+		config.RetentionDays = defaultHistoryRetentionDays
+	}
+
+	path := filepath.Join(dir, historyFileName)
+	store, err := openHistoryStore(path, false)
+	if err != nil {
+		logging.Error("Could not open the history store.", logging.Fields{"error": err, "file": path})
+		return
+	}
+
+	store.maxSize = int64(config.MaxSizeMB) * 1024 * 1024
+	store.retention = time.Duration(config.RetentionDays) * 24 * time.Hour
+	if store.size > store.maxSize {
+		store.compact()
+	}
+
+	logging.Info("Initialized the history store.", logging.Fields{"file": path, "records": len(store.entries)})
+	history = store
+
+	// Drop the records past retention periodically, since compaction on size alone might never happen.
+	go func() {
+		store.expire()
+		for range time.NewTicker(historyRetentionInterval).C {
+			store.expire()
+		}
+	}()
+}
+
+// Function to open the history store at the given path and build its index. Read-only stores are used
+// by local tooling while the agent is running and never modify the file.
+func openHistoryStore(path string, readOnly bool) (*historyStore, error) {
+	flags := os.O_RDONLY
+	if !readOnly {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &historyStore{path: path, file: f}
+	if err := store.buildIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Drop the partially written record left by a crash, so that the next append starts on a new line.
+	if !readOnly {
+		if info, err := f.Stat(); err == nil && info.Size() > store.size {
+			logging.Warn("Truncating partially written history record.", logging.Fields{"file": path})
+			if err := f.Truncate(store.size); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return store, nil
+}
+
+// Function to scan the history file and index every valid record. Corrupted records are skipped.
+func (s *historyStore) buildIndex() error {
+	s.entries = nil
+	s.byEventId = map[string][]int{}
+	s.byRuleId = map[string][]int{}
+	s.byInflight = map[string][]int{}
+	s.size = 0
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without newline is a partially written record.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var record HistoryRecord
+		if json.Unmarshal(bytes.TrimSpace(line), &record) == nil {
+			s.index(record, historyEntry{offset: offset, length: len(line)})
+		}
+		offset += int64(len(line))
+		s.size = offset
+	}
+}
+
+func (s *historyStore) index(record HistoryRecord, entry historyEntry) {
+	i := len(s.entries)
+	s.entries = append(s.entries, entry)
+	if len(record.EventId) > 0 {
+		s.byEventId[record.EventId] = append(s.byEventId[record.EventId], i)
+	}
+	if len(record.RuleId) > 0 {
+		s.byRuleId[record.RuleId] = append(s.byRuleId[record.RuleId], i)
+	}
+	if len(record.InflightActionId) > 0 {
+		s.byInflight[record.InflightActionId] = append(s.byInflight[record.InflightActionId], i)
+	}
+}
+
+// Function to append a record to the history file. The record is synced to disk before returning.
+func (s *historyStore) append(record HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The file is closed if it couldn't be reopened after the last compaction.
+	if s.file == nil {
+		if err := s.reopen(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.index(record, historyEntry{offset: s.size, length: len(data)})
+	s.size += int64(len(data))
+
+	if s.maxSize > 0 && s.size > s.maxSize {
+		s.compact()
+	}
+	return nil
+}
+
+// Function to read the record at the given index. Must be called with the lock held.
+func (s *historyStore) read(i int) (HistoryRecord, error) {
+	var record HistoryRecord
+	entry := s.entries[i]
+	data := make([]byte, entry.length)
+	if _, err := s.file.ReadAt(data, entry.offset); err != nil {
+		return record, err
+	}
+	err := json.Unmarshal(bytes.TrimSpace(data), &record)
+	return record, err
+}
+
+// Function to query the history. Records are returned newest first.
+func (s *historyStore) query(filter HistoryFilter) ([]HistoryRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == nil {
+		return nil, errHistoryClosed
+	}
+
+	// Use the most selective index available, otherwise scan all the records.
+	var candidates []int
+	switch {
+	case len(filter.InflightActionId) > 0:
+		candidates = s.byInflight[filter.InflightActionId]
+	case len(filter.EventId) > 0:
+		candidates = s.byEventId[filter.EventId]
+	case len(filter.RuleId) > 0:
+		candidates = s.byRuleId[filter.RuleId]
+	default:
+		candidates = make([]int, len(s.entries))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryQueryLimit
+	}
+
+	records := []HistoryRecord{}
+	for i := len(candidates) - 1; i >= 0 && len(records) < limit; i-- {
+		record, err := s.read(candidates[i])
+		if err != nil {
+			return records, err
+		}
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (f HistoryFilter) matches(r HistoryRecord) bool {
+	kind := f.Kind
+	if len(kind) == 0 {
+		kind = executionHistoryKind
+	}
+	return (kind == allHistoryKinds || kind == r.Kind) &&
+		(len(f.EventId) == 0 || f.EventId == r.EventId) &&
+		(len(f.RuleId) == 0 || f.RuleId == r.RuleId) &&
+		(len(f.InflightActionId) == 0 || f.InflightActionId == r.InflightActionId) &&
+		(len(f.Status) == 0 || f.Status == r.Status) &&
+		(f.Since == 0 || r.StartTime >= f.Since) &&
+		(f.Until == 0 || r.StartTime <= f.Until)
+}
+
+// Function to compact the history file if its oldest record is past retention. Records are appended
+// in time order so the oldest one is the first.
+func (s *historyStore) expire() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == nil || len(s.entries) == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.retention).UnixNano() / 1000000
+	if record, err := s.read(0); err == nil && recordTime(record) < cutoff {
+		s.compact()
+	}
+}
+
+// Function to rewrite the history file with only the records within retention. If that's still larger
+// than the maximum size, only the newest half of the records are kept. Must be called with the lock held.
+func (s *historyStore) compact() {
+	cutoff := time.Now().Add(-s.retention).UnixNano() / 1000000
+
+	keep := []HistoryRecord{}
+	for i := range s.entries {
+		if record, err := s.read(i); err == nil && recordTime(record) >= cutoff {
+			keep = append(keep, record)
+		}
+	}
+
+	var size int64
+	for _, record := range keep {
+		if data, err := json.Marshal(record); err == nil {
+			size += int64(len(data)) + 1
+		}
+	}
+	if size > s.maxSize {
+		keep = keep[len(keep)/2:]
+	}
+
+	// The file must be closed while it's replaced, since open files can't be renamed over on windows. It's
+	// reopened even if the compaction failed, and left closed until the next append if it can't be.
+	s.file.Close()
+	s.file = nil
+	err := replaceFile(s.path, func(f *os.File) error {
+		w := bufio.NewWriter(f)
+		for _, record := range keep {
+			data, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			w.Write(data)
+			w.WriteByte('\n')
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		logging.Error("Could not compact the history store.", logging.Fields{"error": err})
+	}
+
+	if openErr := s.reopen(); openErr != nil {
+		logging.Error("Could not reopen the history store.", logging.Fields{"error": openErr})
+		return
+	}
+	if err == nil {
+		logging.Info("Compacted the history store.", logging.Fields{"records": len(s.entries)})
+	}
+}
+
+// Function to open the history file again and rebuild its index. Must be called with the lock held.
+func (s *historyStore) reopen() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	if err := s.buildIndex(); err != nil {
+		s.file = nil
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// Function to find the started records which have no execution record, in a single pass over the
+// records. Returns them oldest first.
+func (s *historyStore) unfinished() ([]HistoryRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == nil {
+		return nil, errHistoryClosed
+	}
+
+	started := []HistoryRecord{}
+	finished := map[string]bool{}
+	for i := range s.entries {
+		record, err := s.read(i)
+		if err != nil {
+			return nil, err
+		}
+		switch record.Kind {
+		case startedHistoryKind:
+			started = append(started, record)
+		case executionHistoryKind:
+			finished[record.EventId] = true
+		}
+	}
+
+	records := []HistoryRecord{}
+	for _, record := range started {
+		if !finished[record.EventId] {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Helper function to get the time used for retention of a record.
+func recordTime(r HistoryRecord) int64 {
+	if r.EndTime > 0 {
+		return r.EndTime
+	}
+	return r.StartTime
+}
+
+// Function to add a record to the execution history of this agent.
+func recordHistory(record HistoryRecord) {
+	if history == nil {
+		return
+	}
+	if err := history.append(record); err != nil {
+		logging.Error("Could not append to the history store.", logging.Fields{"error": err})
+	}
+}
+
+// Function to record a finished execution in the history.
+func recordExecution(event *Event, start time.Time, result commandResult) {
+	recordResult(executionHistoryKind, event, start, result)
+	observeExecution(start, result)
+}
+
+// Function to record an attempt of the given event which failed and is going to be retried.
+func recordAttempt(event *Event, start time.Time, result commandResult) {
+	recordResult(attemptHistoryKind, event, start, result)
+}
+
+func recordResult(kind string, event *Event, start time.Time, result commandResult) {
+	digest := sha256.New()
+	digest.Write([]byte(result.Stdout))
+	digest.Write([]byte{0})
+	digest.Write([]byte(result.Stderr))
+
+	recordHistory(HistoryRecord{
+		Kind:             kind,
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		InflightActionId: event.InflightActionId,
+		StartTime:        start.UnixNano() / 1000000,
+		EndTime:          time.Now().UnixNano() / 1000000,
+		Status:           result.Status,
+		ExitCode:         result.StatusCode,
+		OutputDigest:     hex.EncodeToString(digest.Sum(nil)),
+		Attempt:          result.Attempt,
+	})
+}
+
+// Function to query the execution history of this agent.
+func QueryHistory(filter HistoryFilter) ([]HistoryRecord, error) {
+	if history == nil {
+		return nil, errors.New("History store is not initialized.")
+	}
+	return history.query(filter)
+}
+
+// Function to query the history store in the given directory without modifying it. This is meant for
+// local tooling which runs alongside the agent.
+func QueryHistoryFile(dir string, filter HistoryFilter) ([]HistoryRecord, error) {
+	store, err := openHistoryStore(filepath.Join(dir, historyFileName), true)
+	if err != nil {
+		return nil, err
+	}
+	defer store.file.Close()
+	return store.query(filter)
+}
+
+// Function to parse a history filter from a query string like "ruleId=abc&status=FAILED&limit=10".
+// Since and until are in milliseconds since epoch.
+func ParseHistoryFilter(query string) (HistoryFilter, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return HistoryFilter{}, err
+	}
+
+	filter := HistoryFilter{
+		Kind:             values.Get("kind"),
+		EventId:          values.Get("eventId"),
+		RuleId:           values.Get("ruleId"),
+		InflightActionId: values.Get("inflightActionId"),
+		Status:           values.Get("status"),
+	}
+
+	for name, target := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+		if v := values.Get(name); len(v) > 0 {
+			if *target, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return filter, fmt.Errorf("Invalid %s value %q.", name, v)
+			}
+		}
+	}
+
+	if v := values.Get("limit"); len(v) > 0 {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("Invalid limit value %q.", v)
+		}
+	}
+	return filter, nil
+}
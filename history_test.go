@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that appended records are found by the queries, newest first, and survive reopening the store.
+func TestHistoryQuery(t *testing.T) {
+	store := openTestHistory(t)
+	now := time.Now().UnixNano() / 1000000
+
+	records := []HistoryRecord{
+		{Kind: startedHistoryKind, EventId: "e1", RuleId: "r1", StartTime: now},
+		{Kind: executionHistoryKind, EventId: "e1", RuleId: "r1", StartTime: now, Status: "SUCCESS"},
+		{Kind: executionHistoryKind, EventId: "e2", RuleId: "r1", StartTime: now + 1, Status: "FAILED"},
+		{Kind: executionHistoryKind, EventId: "e3", RuleId: "r2", InflightActionId: "i3", StartTime: now + 2, Status: "FAILED"},
+	}
+	for _, record := range records {
+		if err := store.append(record); err != nil {
+			t.Fatalf("append() failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter HistoryFilter
+		want   []string
+	}{
+		{name: "executions by default", filter: HistoryFilter{}, want: []string{"e3", "e2", "e1"}},
+		{name: "all kinds", filter: HistoryFilter{Kind: allHistoryKinds}, want: []string{"e3", "e2", "e1", "e1"}},
+		{name: "journal kind", filter: HistoryFilter{Kind: startedHistoryKind}, want: []string{"e1"}},
+		{name: "rule", filter: HistoryFilter{RuleId: "r1"}, want: []string{"e2", "e1"}},
+		{name: "event", filter: HistoryFilter{EventId: "e2"}, want: []string{"e2"}},
+		{name: "inflight action", filter: HistoryFilter{InflightActionId: "i3"}, want: []string{"e3"}},
+		{name: "status", filter: HistoryFilter{Status: "FAILED"}, want: []string{"e3", "e2"}},
+		{name: "since", filter: HistoryFilter{Since: now + 1}, want: []string{"e3", "e2"}},
+		{name: "limit", filter: HistoryFilter{Limit: 1}, want: []string{"e3"}},
+	}
+
+	check := func(store *historyStore) {
+		for _, test := range tests {
+			got, err := store.query(test.filter)
+			if err != nil {
+				t.Fatalf("%s: query() failed: %v", test.name, err)
+			}
+			if ids := eventIds(got); !equalStrings(ids, test.want) {
+				t.Errorf("%s: query() = %v, want %v", test.name, ids, test.want)
+			}
+		}
+	}
+	check(store)
+
+	store.file.Close()
+	reopened, err := openHistoryStore(store.path, false)
+	if err != nil {
+		t.Fatalf("openHistoryStore() failed: %v", err)
+	}
+	defer reopened.file.Close()
+	check(reopened)
+}
+
+// Test that compaction drops the records past retention and keeps the store usable.
+func TestHistoryCompaction(t *testing.T) {
+	store := openTestHistory(t)
+	store.retention = 24 * time.Hour
+	store.maxSize = 1024 * 1024
+	now := time.Now()
+
+	old := now.Add(-48*time.Hour).UnixNano() / 1000000
+	recent := now.UnixNano() / 1000000
+	for _, record := range []HistoryRecord{
+		{Kind: executionHistoryKind, EventId: "old", StartTime: old, EndTime: old},
+		{Kind: executionHistoryKind, EventId: "recent", StartTime: recent, EndTime: recent},
+	} {
+		if err := store.append(record); err != nil {
+			t.Fatalf("append() failed: %v", err)
+		}
+	}
+
+	store.expire()
+	if got, _ := store.query(HistoryFilter{}); !equalStrings(eventIds(got), []string{"recent"}) {
+		t.Errorf("query() after compaction = %v, want [recent]", eventIds(got))
+	}
+
+	if err := store.append(HistoryRecord{Kind: executionHistoryKind, EventId: "next", StartTime: recent}); err != nil {
+		t.Fatalf("append() after compaction failed: %v", err)
+	}
+	if got, _ := store.query(HistoryFilter{EventId: "next"}); len(got) != 1 {
+		t.Errorf("record appended after compaction was not found")
+	}
+}
+
+// Test that the store is reopened on the next append if it was left closed.
+func TestHistoryAppendAfterClose(t *testing.T) {
+	store := openTestHistory(t)
+	store.file.Close()
+	store.file = nil
+
+	if _, err := store.query(HistoryFilter{}); err != errHistoryClosed {
+		t.Errorf("query() of a closed store error = %v, want %v", err, errHistoryClosed)
+	}
+	if err := store.append(HistoryRecord{Kind: executionHistoryKind, EventId: "e1"}); err != nil {
+		t.Fatalf("append() failed: %v", err)
+	}
+	if got, _ := store.query(HistoryFilter{}); !equalStrings(eventIds(got), []string{"e1"}) {
+		t.Errorf("query() = %v, want [e1]", eventIds(got))
+	}
+}
+
+// Test that only the started executions without a finished record are interrupted.
+func TestHistoryUnfinished(t *testing.T) {
+	store := openTestHistory(t)
+	for _, record := range []HistoryRecord{
+		{Kind: startedHistoryKind, EventId: "finished"},
+		{Kind: startedHistoryKind, EventId: "interrupted"},
+		{Kind: spawnedHistoryKind, EventId: "interrupted", Pid: 10},
+		{Kind: executionHistoryKind, EventId: "finished"},
+	} {
+		if err := store.append(record); err != nil {
+			t.Fatalf("append() failed: %v", err)
+		}
+	}
+
+	got, err := store.unfinished()
+	if err != nil {
+		t.Fatalf("unfinished() failed: %v", err)
+	}
+	if ids := eventIds(got); !equalStrings(ids, []string{"interrupted"}) || got[0].Kind != startedHistoryKind {
+		t.Errorf("unfinished() = %v, want the started record of [interrupted]", got)
+	}
+}
+
+// Function to open an empty history store in a temp directory.
+func openTestHistory(t *testing.T) *historyStore {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openHistoryStore(filepath.Join(dir, historyFileName), false)
+	if err != nil {
+		t.Fatalf("openHistoryStore() failed: %v", err)
+	}
+	store.retention = time.Duration(defaultHistoryRetentionDays) * 24 * time.Hour
+	t.Cleanup(func() {
+		if store.file != nil {
+			store.file.Close()
+		}
+		os.RemoveAll(dir)
+	})
+	return store
+}
+
+func eventIds(records []HistoryRecord) []string {
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.EventId)
+	}
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+// Package inflight is responsible for keeping track of the executions running right now, so that they
+// can be listed and cancelled through the control API. Cancelling an execution kills the processes it
+// has started and keeps it from starting any more, like further steps or retries.
+package agent
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+// Status of an execution cancelled through the control API.
+const cancelledStatus = "CANCELLED"
+
+// Execution running right now. Times are in milliseconds since epoch.
+type InflightExecution struct {
+	EventId          string `json:"eventId"`
+	RuleId           string `json:"ruleId"`
+	RuleName         string `json:"ruleName"`
+	ActionType       string `json:"actionType,omitempty"`
+	InflightActionId string `json:"inflightActionId"`
+	Source           string `json:"source"`
+	StartTime        int64  `json:"startTime"`
+	Timeout          int32  `json:"timeout"`
+	Pids             []int  `json:"pids,omitempty"`
+	Cancelled        bool   `json:"cancelled"`
+}
+
+var errExecutionNotFound = errors.New("No such execution is running.")
+
+// Global variable to hold the executions running right now by event id.
+var inflight = struct {
+	sync.Mutex
+	executions map[string]*InflightExecution
+}{executions: map[string]*InflightExecution{}}
+
+// Function to track the execution of the given event until the returned function is called.
+func startInflight(event *Event) func() {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	inflight.executions[event.EventId] = &InflightExecution{
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		RuleName:         event.RuleName,
+		ActionType:       event.ActionType,
+		InflightActionId: event.InflightActionId,
+		Source:           event.Source,
+		StartTime:        time.Now().UnixNano() / 1000000,
+		Timeout:          event.Timeout,
+	}
+	return func() {
+		inflight.Lock()
+		defer inflight.Unlock()
+		delete(inflight.executions, event.EventId)
+	}
+}
+
+// Function to remember a process started by the given execution so that it can be killed on cancel. A
+// process started after the execution was cancelled is killed right away.
+func addInflightPid(eventId string, pid int) {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	execution, ok := inflight.executions[eventId]
+	if !ok {
+		return
+	}
+	execution.Pids = append(execution.Pids, pid)
+	if execution.Cancelled {
+		killProcessGroup(pid)
+	}
+}
+
+// Function to forget a process of the given execution once it has exited, so that its pid, which may be
+// reused, is never killed on cancel.
+func removeInflightPid(eventId string, pid int) {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	execution, ok := inflight.executions[eventId]
+	if !ok {
+		return
+	}
+	for i, p := range execution.Pids {
+		if p == pid {
+			execution.Pids = append(execution.Pids[:i], execution.Pids[i+1:]...)
+			break
+		}
+	}
+}
+
+// Function to list the executions running right now, oldest first.
+func InflightExecutions() []InflightExecution {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	executions := []InflightExecution{}
+	for _, execution := range inflight.executions {
+		e := *execution
+		e.Pids = append([]int{}, execution.Pids...)
+		executions = append(executions, e)
+	}
+	sort.Slice(executions, func(i, j int) bool { return executions[i].StartTime < executions[j].StartTime })
+	return executions
+}
+
+// Function to check if the execution of the given event was cancelled.
+func isCancelled(eventId string) bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	execution, ok := inflight.executions[eventId]
+	return ok && execution.Cancelled
+}
+
+// Function to cancel the execution of the given event by killing its processes. The execution reports
+// itself as cancelled once its processes have exited.
+func CancelExecution(eventId string) error {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	execution, ok := inflight.executions[eventId]
+	if !ok {
+		return errExecutionNotFound
+	}
+	execution.Cancelled = true
+	for _, pid := range execution.Pids {
+		// The process may have exited already, so errors are only logged.
+		if err := killProcessGroup(pid); err != nil {
+			logging.Debug("Could not kill the process of the cancelled execution.", logging.Fields{"eventId": eventId, "pid": pid, "error": err})
+		}
+	}
+	logging.Info("Cancelled the execution.", logging.Fields{"eventId": eventId, "pids": execution.Pids})
+	return nil
+}
+
+// Function to mark the result of a cancelled execution as such.
+func markCancelled(result *commandResult) {
+	result.Status = cancelledStatus
+	if result.StatusCode == 0 {
+		result.StatusCode = 1
+	}
+	result.Stderr = appendLine(result.Stderr, "Execution was cancelled.")
+}
@@ -0,0 +1,197 @@
+// Package recovery is responsible for reporting the executions interrupted by an agent restart.
+// A started record is journaled in the execution history before every execution and a finished
+// record after it. When the agent comes up, any started execution without a finished record is
+// reported to Neptune.io as interrupted. Its orphaned process group, if still alive, is either
+// killed or adopted until it exits, depending on config.
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Kinds of journal records in the execution history.
+	startedHistoryKind = "started"
+	spawnedHistoryKind = "spawned"
+
+	interruptedStatus = "INTERRUPTED"
+
+	// Policies for the orphaned process group of an interrupted execution.
+	orphanPolicyKill  = "kill"
+	orphanPolicyAdopt = "adopt"
+
+	orphanPollInterval = 5 * time.Second
+
+	// Changes on every boot of a linux host, which tells if a recorded pid could still be ours.
+	bootIdFile = "/proc/sys/kernel/random/boot_id"
+)
+
+var errProcessNotFound = errors.New("No such process.")
+
+// Function to journal that the execution of given event is about to start.
+func recordStarted(event *Event) {
+	recordHistory(HistoryRecord{
+		Kind:             startedHistoryKind,
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		RuleName:         event.RuleName,
+		ActionType:       event.ActionType,
+		InflightActionId: event.InflightActionId,
+		StartTime:        time.Now().UnixNano() / 1000000,
+		Timeout:          event.Timeout,
+	})
+}
+
+// Function to journal the pid of the process started for the given event. The process is also tracked
+// so that it can be killed if the execution is cancelled, until the returned function is called once it
+// has exited.
+func recordSpawned(event *Event, pid int) func() {
+	addInflightPid(event.EventId, pid)
+
+	// The start time tells the process apart from a later one reusing its pid.
+	processStart, err := processStartTime(pid)
+	if err != nil {
+		logging.Debug("Could not get the start time of the process.", logging.Fields{"pid": pid, "error": err})
+	}
+	recordHistory(HistoryRecord{
+		Kind:             spawnedHistoryKind,
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		InflightActionId: event.InflightActionId,
+		StartTime:        time.Now().UnixNano() / 1000000,
+		Pid:              pid,
+		ProcessStart:     processStart,
+		BootId:           currentBootId(),
+	})
+	return func() {
+		removeInflightPid(event.EventId, pid)
+	}
+}
+
+func currentBootId() string {
+	data, err := ioutil.ReadFile(bootIdFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Function to find the executions which were started but never finished.
+func findInterruptedExecutions() []HistoryRecord {
+	if history == nil {
+		return nil
+	}
+	interrupted, err := history.unfinished()
+	if err != nil {
+		logging.Error("Could not look up the executions interrupted by an agent restart.", logging.Fields{"error": err})
+		return nil
+	}
+	return interrupted
+}
+
+// Function to report the executions interrupted by the previous agent run. The interrupted executions
+// are looked up right away, so this must be called before any new event is executed. Handling their
+// orphaned processes and reporting happens in the background.
+func RecoverInterruptedExecutions(regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, config RecoveryConfig) {
+	// The executions are journaled in the history, so nothing can be recovered without it.
+	if history == nil {
+		logging.Error("Executions interrupted by an agent restart can't be recovered since the history store is not available.", nil)
+		return
+	}
+
+	interrupted := findInterruptedExecutions()
+	if len(interrupted) == 0 {
+		return
+	}
+
+	policy := config.OrphanPolicy
+	if policy != orphanPolicyAdopt {
+		policy = orphanPolicyKill
+	}
+	logging.Warn("Found executions interrupted by an agent restart.", logging.Fields{"count": len(interrupted), "policy": policy})
+
+	for _, record := range interrupted {
+		go recoverExecution(regInfo, actionOutputs, record, policy)
+	}
+}
+
+func recoverExecution(regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, started HistoryRecord, policy string) {
+	reason := "Agent restarted while the runbook was running."
+
+	spawned, err := QueryHistory(HistoryFilter{Kind: spawnedHistoryKind, EventId: started.EventId, Limit: 1})
+	if err == nil && len(spawned) > 0 && isOrphanAlive(spawned[0]) {
+		pid := spawned[0].Pid
+		if policy == orphanPolicyAdopt {
+			logging.Info("Adopting the orphaned runbook process.", logging.Fields{"eventId": started.EventId, "pid": pid})
+			if waitForOrphan(spawned[0], started) {
+				reason += " The orphaned runbook process was adopted and has exited; its output and exit code are not available."
+			} else {
+				killProcessGroup(pid)
+				reason += " The orphaned runbook process was adopted and killed after the timeout."
+			}
+		} else {
+			logging.Info("Killing the orphaned runbook process.", logging.Fields{"eventId": started.EventId, "pid": pid})
+			if err := killProcessGroup(pid); err != nil {
+				logging.Error("Could not kill the orphaned runbook process.", logging.Fields{"error": err, "pid": pid})
+			}
+			reason += " The orphaned runbook process was killed."
+		}
+	}
+
+	event := &Event{
+		EventId:          started.EventId,
+		RuleId:           started.RuleId,
+		RuleName:         started.RuleName,
+		ActionType:       started.ActionType,
+		InflightActionId: started.InflightActionId,
+	}
+	if md != nil {
+		event.Hostname = md.HostName
+	}
+
+	result := commandResult{Status: interruptedStatus, StatusCode: 1, Stderr: reason}
+	recordExecution(event, time.Unix(0, started.StartTime*int64(time.Millisecond)), result)
+	sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+}
+
+// Function to check if the recorded process is still alive. The pid may have been reused by an unrelated
+// process since, so it's only considered alive if the process still has the recorded start time. A pid
+// recorded before the host rebooted, or without a start time, is never considered alive.
+func isOrphanAlive(spawned HistoryRecord) bool {
+	if spawned.Pid <= 0 || len(spawned.ProcessStart) == 0 {
+		return false
+	}
+	if bootId := currentBootId(); len(spawned.BootId) > 0 && spawned.BootId != bootId {
+		return false
+	}
+
+	start, err := processStartTime(spawned.Pid)
+	if err == errProcessNotFound {
+		// The leader has exited, but its pid can't be reused while the rest of its process group lives
+		// on. Windows has no process groups.
+		return runtime.GOOS != "windows" && isProcessGroupAlive(spawned.Pid)
+	} else if err != nil {
+		logging.Warn("Could not get the start time of the orphaned process.", logging.Fields{"pid": spawned.Pid, "error": err})
+		return false
+	}
+	return start == spawned.ProcessStart && isProcessGroupAlive(spawned.Pid)
+}
+
+// Function to wait for the adopted process group to exit, up to the timeout of the original execution.
+// Returns false if the timeout passed.
+func waitForOrphan(spawned HistoryRecord, started HistoryRecord) bool {
+	deadline := time.Unix(0, started.StartTime*int64(time.Millisecond)).Add(time.Duration(started.Timeout) * time.Second)
+	for isOrphanAlive(spawned) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(orphanPollInterval)
+	}
+	return true
+}
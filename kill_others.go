@@ -3,7 +3,12 @@
 package agent
 
 import (
+	"errors"
+	"io/ioutil"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/neptuneio/agent/logging"
@@ -21,3 +26,53 @@ func KillCommand(cmd *exec.Cmd) {
 func SetPGroup(cmd *exec.Cmd) {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 }
+
+// Function to check if any process of the process group led by the given pid is still alive.
+func isProcessGroupAlive(pid int) bool {
+	err := syscall.Kill(-pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Function to kill all the processes of the process group led by the given pid.
+func killProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// Function to get the start time of the process with given pid, which tells it apart from a later
+// process reusing the pid. The value is only meant to be compared. It's the start time in clock ticks
+// since boot on linux, and the start time printed by ps elsewhere.
+func processStartTime(pid int) (string, error) {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return "", errProcessNotFound
+	}
+
+	if runtime.GOOS != "linux" {
+		out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", err
+	}
+
+	// The command name may contain spaces, so the fields are counted after it. Start time is the 22nd
+	// field, and the fields after the command name start at the 3rd.
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return "", errors.New("Unexpected format of the process stat.")
+	}
+	return fields[19], nil
+}
+
+// Function to stop the process with given pid, gracefully unless forced.
+func terminateProcess(pid int, force bool) error {
+	if force {
+		return syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
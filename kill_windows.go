@@ -1,11 +1,19 @@
 package agent
 
 import (
+	"os"
 	"os/exec"
+	"strconv"
+	"syscall"
 
 	"github.com/neptuneio/agent/logging"
 )
 
+const (
+	processQueryLimitedInformation = 0x1000
+	errorInvalidParameter          = syscall.Errno(87)
+)
+
 func KillCommand(cmd *exec.Cmd) {
 	err := cmd.Process.Kill()
 	if err != nil {
@@ -16,3 +24,51 @@ func KillCommand(cmd *exec.Cmd) {
 func SetPGroup(cmd *exec.Cmd) {
 	// Nothing to do.
 }
+
+// Function to check if the process with given pid is still alive. There are no process groups here
+// so only the process itself is checked.
+func isProcessGroupAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Function to kill the process with given pid.
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// Function to get the creation time of the process with given pid, which tells it apart from a later
+// process reusing the pid. The value is only meant to be compared.
+func processStartTime(pid int) (string, error) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err == errorInvalidParameter {
+		return "", errProcessNotFound
+	} else if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return "", err
+	}
+	// A process which exited but whose handle is still held by someone has an exit time.
+	if exit.HighDateTime != 0 || exit.LowDateTime != 0 {
+		return "", errProcessNotFound
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10), nil
+}
+
+// Function to stop the process with given pid. Windows has no graceful signal, so the process is
+// always killed.
+func terminateProcess(pid int, force bool) error {
+	return killProcessGroup(pid)
+}
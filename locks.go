@@ -0,0 +1,283 @@
+// Package locks is responsible for the named locks which keep conflicting runbooks from running at the
+// same time on a host, like "rotate logs" and "restart app". A runbook declares the locks it needs,
+// each in exclusive or shared mode, and waits for them up to a timeout before it runs. The locks can
+// also be taken as flocks on host-wide lock files, so that other tools on the host can cooperate.
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Lock modes. Shared locks of the same name can be held together, an exclusive lock can't be held
+	// together with any other lock of the same name.
+	exclusiveLock = "exclusive"
+	sharedLock    = "shared"
+
+	// Status of an execution whose runbook didn't run because it couldn't get its locks in time.
+	lockTimeoutStatus = "LOCK_TIMEOUT"
+
+	defaultLockWaitSeconds = 60
+	lockFileExtension      = ".lock"
+	lockFilePollInterval   = 500 * time.Millisecond
+)
+
+var errHostLocksUnsupported = errors.New("Host-wide locks are not supported on this platform.")
+
+// Named lock declared by a runbook. Mode is "exclusive", the default, or "shared". WaitSeconds is how
+// long the runbook waits for the lock.
+type LockSpec struct {
+	Name        string `json:"name"`
+	Mode        string `json:"mode"`
+	WaitSeconds int    `json:"waitSeconds"`
+}
+
+// State of a named lock within the agent. Changed is closed and replaced whenever the lock is released
+// or a waiter gives up. Waiting counts the exclusive waiters, which keep new shared holders out so that a
+// steady stream of shared holders can't starve them.
+type namedLock struct {
+	exclusive bool
+	shared    int
+	waiting   int
+	changed   chan struct{}
+}
+
+// Locks held by an execution.
+type heldLocks struct {
+	specs []LockSpec
+	files []*os.File
+}
+
+// Global variables to hold the lock settings and the locks held within the agent.
+var locksConfig LocksConfig
+var locksLock sync.Mutex
+var namedLocks = map[string]*namedLock{}
+
+// Function to initialize the lock settings from agent config. Host-wide lock files are kept in the
+// configured directory, or in the "locks" directory under the given one.
+func InitializeLocks(config LocksConfig, dir string) {
+	if config.HostWide {
+		config.Dir = absPath(dir, config.Dir)
+		if len(config.Dir) == 0 {
+			config.Dir = filepath.Join(dir, "locks")
+		}
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			logging.Error("Could not create the lock files directory.", logging.Fields{"error": err, "dir": config.Dir})
+			config.HostWide = false
+		}
+	}
+	locksConfig = config
+	logging.Info("Initialized runbook locks.", logging.Fields{"hostWide": config.HostWide, "dir": config.Dir})
+}
+
+// Function to get the locks declared for the given event by the event itself, its manifest and the agent
+// config of its runbook. A lock declared more than once is exclusive if any declaration is.
+func locksFor(event *Event, manifest *RunbookManifest) ([]LockSpec, error) {
+	specs := append([]LockSpec{}, event.Locks...)
+	if manifest != nil {
+		specs = append(specs, manifest.Locks...)
+	}
+	for _, name := range []string{event.RunbookName, event.GithubFilePath} {
+		if len(name) > 0 {
+			specs = append(specs, locksConfig.Runbooks[name]...)
+		}
+	}
+
+	merged := map[string]LockSpec{}
+	for _, spec := range specs {
+		if len(spec.Name) == 0 {
+			return nil, errors.New("Lock without name.")
+		}
+		switch spec.Mode {
+		case "":
+			spec.Mode = exclusiveLock
+		case exclusiveLock, sharedLock:
+		default:
+			return nil, fmt.Errorf("Lock %q has unknown mode %q.", spec.Name, spec.Mode)
+		}
+		if spec.WaitSeconds <= 0 {
+			spec.WaitSeconds = locksConfig.DefaultWaitSeconds
+			if spec.WaitSeconds <= 0 {
+				spec.WaitSeconds = defaultLockWaitSeconds
+			}
+		}
+
+		if existing, ok := merged[spec.Name]; ok {
+			if existing.Mode == exclusiveLock {
+				spec.Mode = exclusiveLock
+			}
+			if existing.WaitSeconds > spec.WaitSeconds {
+				spec.WaitSeconds = existing.WaitSeconds
+			}
+		}
+		merged[spec.Name] = spec
+	}
+
+	// Locks are always taken in the order of their names so that two runbooks can't deadlock.
+	result := []LockSpec{}
+	for _, spec := range merged {
+		result = append(result, spec)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// Function to get the total time the given locks may be waited for.
+func maxLockWait(specs []LockSpec) time.Duration {
+	var total time.Duration
+	for _, spec := range specs {
+		total += time.Duration(spec.WaitSeconds) * time.Second
+	}
+	return total
+}
+
+// Function to take the given locks, waiting for each up to its timeout. On failure, the locks taken so
+// far are released and the error names the lock which couldn't be taken.
+func acquireLocks(eventId string, specs []LockSpec) (*heldLocks, error) {
+	held := &heldLocks{}
+	for _, spec := range specs {
+		deadline := time.Now().Add(time.Duration(spec.WaitSeconds) * time.Second)
+		if !acquireNamedLock(spec, deadline) {
+			held.release()
+			return nil, fmt.Errorf("Timed out waiting %ds for the %s lock %s.", spec.WaitSeconds, spec.Mode, spec.Name)
+		}
+		held.specs = append(held.specs, spec)
+
+		if locksConfig.HostWide {
+			f, err := acquireLockFile(spec, deadline)
+			if err != nil {
+				held.release()
+				return nil, fmt.Errorf("Could not take the %s lock file %s. %v", spec.Mode, spec.Name, err)
+			}
+			if f != nil {
+				held.files = append(held.files, f)
+			}
+		}
+		logging.Debug("Took the runbook lock.", logging.Fields{"eventId": eventId, "lock": spec.Name, "mode": spec.Mode})
+	}
+	return held, nil
+}
+
+// Function to take a lock within the agent, waiting until the deadline. Exclusive waiters are preferred
+// over new shared holders. Host-wide lock files have no such preference, flock gives no ordering between
+// processes, so a busy shared lock file can keep an exclusive runbook waiting until its timeout.
+func acquireNamedLock(spec LockSpec, deadline time.Time) bool {
+	waiting := false
+	for {
+		locksLock.Lock()
+		l, ok := namedLocks[spec.Name]
+		if !ok {
+			l = &namedLock{changed: make(chan struct{})}
+			namedLocks[spec.Name] = l
+		}
+
+		if spec.Mode == sharedLock && !l.exclusive && l.waiting == 0 {
+			l.shared++
+			locksLock.Unlock()
+			return true
+		}
+		if spec.Mode == exclusiveLock && !l.exclusive && l.shared == 0 {
+			l.exclusive = true
+			if waiting {
+				l.waiting--
+			}
+			locksLock.Unlock()
+			return true
+		}
+		if spec.Mode == exclusiveLock && !waiting {
+			l.waiting++
+			waiting = true
+		}
+		changed := l.changed
+		locksLock.Unlock()
+
+		wait := deadline.Sub(time.Now())
+		if wait > 0 {
+			select {
+			case <-changed:
+				continue
+			case <-time.After(wait):
+			}
+		}
+
+		if waiting {
+			stopWaiting(spec.Name)
+		}
+		return false
+	}
+}
+
+// Function to stop an exclusive waiter from keeping out the shared holders of the given lock.
+func stopWaiting(name string) {
+	locksLock.Lock()
+	defer locksLock.Unlock()
+
+	l := namedLocks[name]
+	l.waiting--
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if !l.exclusive && l.shared == 0 && l.waiting == 0 {
+		delete(namedLocks, name)
+	}
+}
+
+func releaseNamedLock(spec LockSpec) {
+	locksLock.Lock()
+	defer locksLock.Unlock()
+
+	l, ok := namedLocks[spec.Name]
+	if !ok {
+		return
+	}
+	if spec.Mode == sharedLock {
+		l.shared--
+	} else {
+		l.exclusive = false
+	}
+
+	// Wake up the waiters and forget the lock once nobody holds it.
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if !l.exclusive && l.shared == 0 && l.waiting == 0 {
+		delete(namedLocks, spec.Name)
+	}
+}
+
+// Function to take the host-wide lock file of the given lock, polling until the deadline since flock
+// can't wait with a timeout. Returns nil file if host-wide locks aren't supported on this platform.
+func acquireLockFile(spec LockSpec, deadline time.Time) (*os.File, error) {
+	path := filepath.Join(locksConfig.Dir, safeFileName(spec.Name)+lockFileExtension)
+	for {
+		f, err := tryLockFile(path, spec.Mode == exclusiveLock)
+		if err == errHostLocksUnsupported {
+			return nil, nil
+		} else if err != nil || f != nil {
+			return f, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out waiting for another process holding the lock file.")
+		}
+		time.Sleep(lockFilePollInterval)
+	}
+}
+
+// Function to release all the held locks.
+func (h *heldLocks) release() {
+	for _, f := range h.files {
+		unlockFile(f)
+	}
+	for _, spec := range h.specs {
+		releaseNamedLock(spec)
+	}
+	h.files = nil
+	h.specs = nil
+}
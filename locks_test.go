@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Test that shared locks are held together and exclusive locks are held alone.
+func TestAcquireNamedLock(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   string
+		mode   string
+		wantOk bool
+	}{
+		{name: "shared with shared", held: sharedLock, mode: sharedLock, wantOk: true},
+		{name: "exclusive with shared", held: sharedLock, mode: exclusiveLock, wantOk: false},
+		{name: "shared with exclusive", held: exclusiveLock, mode: sharedLock, wantOk: false},
+		{name: "exclusive with exclusive", held: exclusiveLock, mode: exclusiveLock, wantOk: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			held := LockSpec{Name: "lock", Mode: test.held}
+			if !acquireNamedLock(held, time.Now()) {
+				t.Fatalf("acquireNamedLock() of a free lock failed")
+			}
+			defer releaseNamedLock(held)
+
+			spec := LockSpec{Name: "lock", Mode: test.mode}
+			start := time.Now()
+			ok := acquireNamedLock(spec, start.Add(100*time.Millisecond))
+			if ok {
+				releaseNamedLock(spec)
+			}
+			if ok != test.wantOk {
+				t.Errorf("acquireNamedLock() = %v, want %v", ok, test.wantOk)
+			}
+			if !ok && time.Since(start) < 100*time.Millisecond {
+				t.Errorf("acquireNamedLock() gave up before the deadline")
+			}
+		})
+	}
+
+	if len(namedLocks) != 0 {
+		t.Errorf("namedLocks = %v after all the locks were released", namedLocks)
+	}
+}
+
+// Test that a waiter gets the lock once it is released.
+func TestAcquireNamedLockAfterRelease(t *testing.T) {
+	held := LockSpec{Name: "lock", Mode: exclusiveLock}
+	acquireNamedLock(held, time.Now())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releaseNamedLock(held)
+	}()
+
+	spec := LockSpec{Name: "lock", Mode: exclusiveLock}
+	if !acquireNamedLock(spec, time.Now().Add(5*time.Second)) {
+		t.Fatalf("acquireNamedLock() failed after the lock was released")
+	}
+	releaseNamedLock(spec)
+}
+
+// Test that an exclusive waiter keeps new shared holders out until it gives up.
+func TestExclusiveWaiterIsPreferred(t *testing.T) {
+	shared := LockSpec{Name: "lock", Mode: sharedLock}
+	acquireNamedLock(shared, time.Now())
+	defer releaseNamedLock(shared)
+
+	done := make(chan bool)
+	go func() {
+		done <- acquireNamedLock(LockSpec{Name: "lock", Mode: exclusiveLock}, time.Now().Add(200*time.Millisecond))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if acquireNamedLock(shared, time.Now()) {
+		releaseNamedLock(shared)
+		t.Errorf("acquireNamedLock() of a shared lock succeeded with an exclusive waiter")
+	}
+	if <-done {
+		t.Fatalf("acquireNamedLock() of the exclusive lock succeeded while the shared lock is held")
+	}
+	if !acquireNamedLock(shared, time.Now()) {
+		t.Errorf("acquireNamedLock() of a shared lock failed after the exclusive waiter gave up")
+	} else {
+		releaseNamedLock(shared)
+	}
+}
+
+// Test that host-wide lock files conflict like the locks within the agent.
+func TestAcquireLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Host-wide lock files are not supported on windows.")
+	}
+	dir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := locksConfig
+	defer func() {
+		locksConfig = oldConfig
+		os.RemoveAll(dir)
+	}()
+	locksConfig = LocksConfig{HostWide: true, Dir: dir}
+
+	shared := LockSpec{Name: "lock", Mode: sharedLock}
+	f, err := acquireLockFile(shared, time.Now())
+	if err != nil || f == nil {
+		t.Fatalf("acquireLockFile() = %v, %v, want the lock file", f, err)
+	}
+	defer unlockFile(f)
+
+	other, err := acquireLockFile(shared, time.Now())
+	if err != nil || other == nil {
+		t.Fatalf("acquireLockFile() of a shared lock = %v, %v, want the lock file", other, err)
+	}
+	unlockFile(other)
+
+	if _, err := acquireLockFile(LockSpec{Name: "lock", Mode: exclusiveLock}, time.Now()); err == nil {
+		t.Errorf("acquireLockFile() of an exclusive lock succeeded while a shared lock is held")
+	}
+}
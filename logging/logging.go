@@ -88,9 +88,12 @@ func SetupLogger(logfile string, debugMode bool, errorsChannel chan string) erro
 		log.Level = logrus.InfoLevel
 	}
 
-	log.Formatter = &logrus.TextFormatter{
-		DisableColors: true,
-		FullTimestamp: true,
+	// Mask the secrets before anything is written to the log file.
+	log.Formatter = &redactingFormatter{
+		formatter: &logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		},
 	}
 	return nil
 }
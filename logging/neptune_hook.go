@@ -50,7 +50,7 @@ func (hook *NeptuneHook) Fire(entry *logrus.Entry) error {
 		}
 	}
 
-	hook.errorsCh <- strings.Join(s, " ")
+	hook.errorsCh <- Redact(strings.Join(s, " "))
 	return nil
 }
 
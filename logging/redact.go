@@ -0,0 +1,202 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// Text used in place of every redacted value.
+	RedactedText = "[REDACTED]"
+
+	// Values shorter than this are not masked since they would mangle unrelated text.
+	minSensitiveValueLength = 4
+
+	// Number of rotating values kept, so that credentials and secrets which change all the time don't
+	// grow the redactor without bound.
+	maxRotatingSensitiveValues = 1024
+)
+
+// Common token formats masked by default.
+var builtinRedactionPatterns = []string{
+	// AWS access key ids.
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// AWS secret access keys assigned to a well known name.
+	`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40,}`,
+	// Github personal access, OAuth, user-to-server, server-to-server and refresh tokens.
+	`\bgh[pousr]_[A-Za-z0-9]{36,255}\b`,
+	// Github fine-grained personal access tokens.
+	`\bgithub_pat_[A-Za-z0-9_]{22,255}\b`,
+	// PEM blocks such as private keys and certificates.
+	`-----BEGIN [A-Z0-9 ]+-----[\s\S]*?-----END [A-Z0-9 ]+-----`,
+}
+
+// Redactor masks known secret values and text matching the configured patterns. Rotating values are
+// kept oldest first and only the latest of them are masked.
+type redactor struct {
+	sync.RWMutex
+	values   map[string]struct{}
+	rotating []string
+	replacer *strings.Replacer
+	patterns []*regexp.Regexp
+}
+
+var defaultRedactor = newRedactor()
+
+func newRedactor() *redactor {
+	r := &redactor{values: map[string]struct{}{}}
+	for _, p := range builtinRedactionPatterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(p))
+	}
+	return r
+}
+
+// Function to register values which must never show up in logs, runbook output or uploaded errors, like
+// the credentials in the agent config. They are masked for as long as the agent runs.
+func AddSensitiveValues(values ...string) {
+	defaultRedactor.Lock()
+	defer defaultRedactor.Unlock()
+
+	changed := false
+	for _, v := range values {
+		if len(v) < minSensitiveValueLength {
+			continue
+		}
+		if _, ok := defaultRedactor.values[v]; !ok {
+			defaultRedactor.values[v] = struct{}{}
+			changed = true
+		}
+	}
+	if changed {
+		defaultRedactor.update()
+	}
+}
+
+// Function to register values which change over time, like the secrets resolved for an execution or
+// the temporary AWS credentials. Only the latest values are masked, registering a value again makes it
+// the latest.
+func AddRotatingSensitiveValues(values ...string) {
+	defaultRedactor.Lock()
+	defer defaultRedactor.Unlock()
+
+	for _, v := range values {
+		if len(v) < minSensitiveValueLength {
+			continue
+		}
+		for i, existing := range defaultRedactor.rotating {
+			if existing == v {
+				defaultRedactor.rotating = append(defaultRedactor.rotating[:i], defaultRedactor.rotating[i+1:]...)
+				break
+			}
+		}
+		defaultRedactor.rotating = append(defaultRedactor.rotating, v)
+	}
+	if extra := len(defaultRedactor.rotating) - maxRotatingSensitiveValues; extra > 0 {
+		defaultRedactor.rotating = append([]string{}, defaultRedactor.rotating[extra:]...)
+	}
+	defaultRedactor.update()
+}
+
+// Function to rebuild the replacer of the known values. Must be called with the lock held.
+func (r *redactor) update() {
+	sorted := []string{}
+	for v := range r.values {
+		sorted = append(sorted, v)
+	}
+	sorted = append(sorted, r.rotating...)
+
+	// Replace the longest values first so that a value containing another one is fully masked.
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	oldNew := []string{}
+	for _, v := range sorted {
+		oldNew = append(oldNew, v, RedactedText)
+	}
+	r.replacer = strings.NewReplacer(oldNew...)
+}
+
+// Function to set the regular expressions used to mask text, in addition to the known secret values.
+// The built-in token formats are kept unless disabled.
+func SetRedactionPatterns(patterns []string, disableBuiltin bool) error {
+	compiled := []*regexp.Regexp{}
+	if !disableBuiltin {
+		for _, p := range builtinRedactionPatterns {
+			compiled = append(compiled, regexp.MustCompile(p))
+		}
+	}
+
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("Invalid redaction pattern %q: %v", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	defaultRedactor.Lock()
+	defaultRedactor.patterns = compiled
+	defaultRedactor.Unlock()
+	return nil
+}
+
+// Function to mask all the known secret values and configured patterns in the given text.
+func Redact(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+
+	defaultRedactor.RLock()
+	defer defaultRedactor.RUnlock()
+
+	if defaultRedactor.replacer != nil {
+		s = defaultRedactor.replacer.Replace(s)
+	}
+	for _, re := range defaultRedactor.patterns {
+		s = re.ReplaceAllString(s, RedactedText)
+	}
+	return s
+}
+
+// Formatter which redacts the entry before handing it over to the wrapped formatter.
+type redactingFormatter struct {
+	formatter logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := &logrus.Entry{
+		Logger:  entry.Logger,
+		Data:    make(logrus.Fields, len(entry.Data)),
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: Redact(entry.Message),
+	}
+
+	// Only the values which contained a secret are replaced by their redacted text, the others are kept
+	// as they are so that the formatter still sees their type.
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			redacted.Data[k] = Redact(v)
+		case error:
+			if s := Redact(v.Error()); s != v.Error() {
+				redacted.Data[k] = s
+			} else {
+				redacted.Data[k] = v
+			}
+		default:
+			s := fmt.Sprintf("%v", v)
+			if r := Redact(s); r != s {
+				redacted.Data[k] = r
+			} else {
+				redacted.Data[k] = v
+			}
+		}
+	}
+
+	return f.formatter.Format(redacted)
+}
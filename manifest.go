@@ -0,0 +1,495 @@
+// Package runbook is responsible for running multi-step runbooks. A runbook whose content is a JSON
+// manifest listing steps is run as a DAG. A step starts as soon as the steps it depends on have
+// finished, so independent steps run in parallel. Every step has its own timeout and retry policy,
+// can be allowed to fail without failing the runbook, and can be made conditional on the results of
+// the steps it depends on. Runbooks which are plain scripts keep running as before.
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Status of a step. Skipped steps didn't run because a condition wasn't met or a dependency failed.
+	stepSuccess = "SUCCESS"
+	stepFailed  = "FAILED"
+	stepTimeout = "TIMEOUT"
+	stepSkipped = "SKIPPED"
+
+	manifestExtension = ".json"
+
+	// Environment variables telling a step which step and attempt it is.
+	stepNameEnvVar    = "NEPTUNE_STEP_NAME"
+	stepAttemptEnvVar = "NEPTUNE_STEP_ATTEMPT"
+)
+
+// Declarative runbook listing the steps to run, the health checks around them, the locks they need,
+// and optionally the runbook to run if they fail.
+type RunbookManifest struct {
+	Steps      []RunbookStep `json:"steps"`
+	Rollback   *RunbookRef   `json:"rollback"`
+	PreChecks  []HealthCheck `json:"preChecks"`
+	PostChecks []HealthCheck `json:"postChecks"`
+	Locks      []LockSpec    `json:"locks"`
+}
+
+// Step of a runbook manifest. The script of the step is either inline or a Github file path.
+type RunbookStep struct {
+	Name            string          `json:"name"`
+	Run             string          `json:"run"`
+	GithubFilePath  string          `json:"githubFilePath"`
+	DependsOn       []string        `json:"dependsOn"`
+	Timeout         int32           `json:"timeout"`
+	Retry           *RetryPolicy    `json:"retry"`
+	ContinueOnError bool            `json:"continueOnError"`
+	When            []StepCondition `json:"when"`
+}
+
+// Condition on the result of an earlier step. The step must be one of the dependencies so that its
+// result is known. All the conditions of a step must hold for it to run.
+type StepCondition struct {
+	Step     string `json:"step"`
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exitCode"`
+}
+
+// Result of a step reported to Neptune.io along with the result of the whole runbook.
+type StepResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	StatusCode int    `json:"statusCode"`
+	IsTimeout  bool   `json:"isTimeout"`
+	Attempts   int    `json:"attempts"`
+	SkipReason string `json:"skipReason,omitempty"`
+	StartTime  int64  `json:"startTime,omitempty"`
+	EndTime    int64  `json:"endTime,omitempty"`
+
+	Output                 string `json:"output"`
+	OutputEncoding         string `json:"outputEncoding,omitempty"`
+	OutputTruncated        bool   `json:"outputTruncated,omitempty"`
+	FailureReason          string `json:"failureReason"`
+	FailureReasonEncoding  string `json:"failureReasonEncoding,omitempty"`
+	FailureReasonTruncated bool   `json:"failureReasonTruncated,omitempty"`
+}
+
+// State of a step while the manifest runs.
+type stepState struct {
+	step   RunbookStep
+	result StepResult
+	stdout string
+	stderr string
+
+	// Whether the failure of this step fails its dependents and the runbook.
+	blocking bool
+}
+
+// Function to parse the runbook content as a manifest. Returns nil manifest and nil error if the
+// content is a plain script, and an error if it's a manifest but not a valid one.
+func parseRunbookManifest(content string) (*RunbookManifest, error) {
+	trimmed := strings.TrimSpace(content)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return nil, nil
+	}
+	if _, ok := fields["steps"]; !ok {
+		return nil, nil
+	}
+
+	manifest := &RunbookManifest{}
+	if err := json.Unmarshal([]byte(trimmed), manifest); err != nil {
+		return nil, err
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (m *RunbookManifest) validate() error {
+	if len(m.Steps) == 0 {
+		return errors.New("Runbook manifest has no steps.")
+	}
+	if m.Rollback != nil {
+		if err := m.Rollback.validate(); err != nil {
+			return err
+		}
+	}
+
+	steps := map[string]RunbookStep{}
+	for _, step := range m.Steps {
+		if len(step.Name) == 0 {
+			return errors.New("Runbook manifest has a step without name.")
+		}
+		if _, ok := steps[step.Name]; ok {
+			return fmt.Errorf("Step %q is defined more than once.", step.Name)
+		}
+		if (len(step.Run) > 0) == (len(step.GithubFilePath) > 0) {
+			return fmt.Errorf("Step %q must have exactly one of run and githubFilePath.", step.Name)
+		}
+		if step.Timeout < 0 || (step.Retry != nil && (step.Retry.MaxAttempts < 0 || step.Retry.DelaySeconds < 0 || step.Retry.MaxDelaySeconds < 0)) {
+			return fmt.Errorf("Step %q has a negative timeout or retry setting.", step.Name)
+		}
+		steps[step.Name] = step
+	}
+
+	for _, step := range m.Steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := steps[dep]; !ok {
+				return fmt.Errorf("Step %q depends on unknown step %q.", step.Name, dep)
+			}
+		}
+		for _, c := range step.When {
+			if !containsString(step.DependsOn, c.Step) {
+				return fmt.Errorf("Step %q has a condition on %q which it doesn't depend on.", step.Name, c.Step)
+			}
+			switch c.Status {
+			case "", stepSuccess, stepFailed, stepTimeout, stepSkipped:
+			default:
+				return fmt.Errorf("Step %q has a condition on unknown status %q.", step.Name, c.Status)
+			}
+		}
+	}
+
+	// Look for a cycle with a depth first search.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("Steps have a dependency cycle through %q.", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dep := range steps[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	for _, step := range m.Steps {
+		if err := visit(step.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the scripts of all the steps, fetching the Github ones. This is done before anything
+// runs so that a runbook doesn't fail halfway because Github wasn't reachable.
+func loadStepScripts(manifest *RunbookManifest, githubKey string) (map[string]string, error) {
+	scripts := map[string]string{}
+	for _, step := range manifest.Steps {
+		if len(step.Run) > 0 {
+			scripts[step.Name] = step.Run
+			continue
+		}
+
+		if githubKey == "" {
+			logging.Error("Github api key is empty.", logging.Fields{"step": step.Name})
+			return nil, errors.New("Empty Github api key.")
+		}
+		content, err := getRunbookFromGithub(githubKey, step.GithubFilePath)
+		if err != nil {
+			return nil, err
+		}
+		scripts[step.Name] = content
+	}
+	return scripts, nil
+}
+
+// Function to run the steps of the manifest for the given event within the timeout of the event. The SQS
+// message is deleted once the first step is about to start. The combined result has the output of all
+// the steps and fails if any step failed without being allowed to.
+func runManifest(regInfo *RegistrationInfo, event *Event, manifest *RunbookManifest, scripts map[string]string, extraEnv map[string]string) commandResult {
+	deadline := time.Now().Add(time.Second * time.Duration(event.Timeout))
+
+	tmpFiles := map[string]string{}
+	defer func() {
+		for _, f := range tmpFiles {
+			os.Remove(f)
+		}
+	}()
+	for _, step := range manifest.Steps {
+		script := scripts[step.Name]
+		runbookName := event.RunbookName
+		if len(step.GithubFilePath) > 0 {
+			runbookName = step.GithubFilePath
+		}
+		tmpFile, err := writeToTmpFile(event.EventId+"-"+safeFileName(step.Name), runbookName, &script)
+		if err != nil {
+			DeleteMessage(regInfo, &event.ReceiptHandle)
+			return commandResult{Status: stepFailed, StatusCode: 1, Stderr: "Could not write the commands of step " + step.Name + " to a file."}
+		}
+		tmpFiles[step.Name] = tmpFile
+	}
+
+	var t *transcript
+	if outputConfig.CombinedTranscript {
+		t = newTranscript(event)
+	}
+
+	// Delete the SQS message since the runbook is starting.
+	DeleteMessage(regInfo, &event.ReceiptHandle)
+
+	states := map[string]*stepState{}
+	started := map[string]bool{}
+	done := make(chan *stepState)
+	running := 0
+
+	for len(states) < len(manifest.Steps) {
+		// Start or skip every step whose dependencies have finished. Skipping a step may let others
+		// proceed, so keep going until nothing changes.
+		changed := true
+		for changed {
+			changed = false
+			for _, step := range manifest.Steps {
+				if started[step.Name] || !dependenciesFinished(step, states) {
+					continue
+				}
+				started[step.Name] = true
+				changed = true
+
+				if reason, blocking := skipReason(event, step, states, deadline); len(reason) > 0 {
+					logging.Info("Skipping runbook step.", logging.Fields{"eventId": event.EventId, "step": step.Name, "reason": reason})
+					states[step.Name] = &stepState{
+						step:     step,
+						result:   StepResult{Name: step.Name, Status: stepSkipped, SkipReason: reason},
+						blocking: blocking,
+					}
+					continue
+				}
+
+				running++
+				go func(step RunbookStep) {
+					done <- runStep(event, step, tmpFiles[step.Name], strings.HasPrefix(scripts[step.Name], shebangPrefix), extraEnv, t, deadline)
+				}(step)
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+		state := <-done
+		running--
+		states[state.step.Name] = state
+	}
+
+	result := manifestResult(manifest, states)
+	if t != nil {
+		result.Transcript = t.finish()
+	}
+	return result
+}
+
+// Function to summarize the results of the steps, which is reported instead of their combined output.
+// Returns the status of every step and the steps which didn't succeed.
+func stepsSummary(steps []StepResult) (string, string) {
+	var stdout, stderr bytes.Buffer
+	for _, step := range steps {
+		fmt.Fprintf(&stdout, "==> %s: %s\n", step.Name, step.Status)
+		if step.Status == stepFailed || step.Status == stepTimeout {
+			fmt.Fprintf(&stderr, "Step %s finished with status %s and exit code %d.\n", step.Name, step.Status, step.StatusCode)
+		}
+	}
+	return stdout.String(), stderr.String()
+}
+
+func dependenciesFinished(step RunbookStep, states map[string]*stepState) bool {
+	for _, dep := range step.DependsOn {
+		if _, ok := states[dep]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to check if the given step must be skipped. Returns the reason and whether the skip fails the
+// runbook, which is the case when a dependency failed, the runbook ran out of time or was cancelled.
+func skipReason(event *Event, step RunbookStep, states map[string]*stepState, deadline time.Time) (string, bool) {
+	for _, dep := range step.DependsOn {
+		if states[dep].blocking {
+			return fmt.Sprintf("Dependency %s did not succeed.", dep), true
+		}
+	}
+
+	for _, c := range step.When {
+		result := states[c.Step].result
+		if len(c.Status) > 0 && result.Status != c.Status {
+			return fmt.Sprintf("Step %s has status %s instead of %s.", c.Step, result.Status, c.Status), false
+		}
+		if c.ExitCode != nil && (result.Status == stepSkipped || result.StatusCode != *c.ExitCode) {
+			return fmt.Sprintf("Step %s did not exit with code %d.", c.Step, *c.ExitCode), false
+		}
+	}
+
+	if !time.Now().Before(deadline) {
+		return "Runbook timed out before the step could start.", !step.ContinueOnError
+	}
+	if isCancelled(event.EventId) {
+		return "Execution was cancelled before the step could start.", true
+	}
+	return "", false
+}
+
+// Function to run a step, retrying it as per its policy. Every attempt is limited by the timeout of the
+// step and the time left for the runbook.
+func runStep(event *Event, step RunbookStep, tmpFile string, hasShebang bool, extraEnv map[string]string, t *transcript, deadline time.Time) *stepState {
+	env := map[string]string{stepNameEnvVar: step.Name}
+	for k, v := range extraEnv {
+		env[k] = v
+	}
+
+	start := time.Now()
+	var result commandResult
+	attempt := 1
+	for ; ; attempt++ {
+		timeout := deadline.Sub(time.Now())
+		if limit := time.Duration(step.Timeout) * time.Second; step.Timeout > 0 && limit < timeout {
+			timeout = limit
+		}
+
+		logging.Info("Running runbook step.", logging.Fields{"eventId": event.EventId, "step": step.Name, "attempt": attempt})
+		env[stepAttemptEnvVar] = fmt.Sprint(attempt)
+		cmd := scriptCommand(tmpFile, hasShebang)
+		cmd.Env = commandEnv(event, env)
+		result = runCommand(cmd, timeout, t, step.Name+"/", func(pid int) func() {
+			if pid > 0 {
+				return recordSpawned(event, pid)
+			}
+			return nil
+		})
+
+		delay := step.Retry.delay(attempt)
+		if attempt >= step.Retry.maxAttempts() || !step.Retry.shouldRetry(result) || time.Now().Add(delay).After(deadline) || isCancelled(event.EventId) {
+			break
+		}
+		logging.Info("Retrying the failed runbook step.", logging.Fields{"eventId": event.EventId, "step": step.Name, "exitCode": result.StatusCode})
+		time.Sleep(delay)
+	}
+	end := time.Now()
+
+	stepResult := newStepResult(step.Name, result, start, end)
+	stepResult.Attempts = attempt
+	return &stepState{
+		step:     step,
+		result:   stepResult,
+		stdout:   result.Stdout,
+		stderr:   result.Stderr,
+		blocking: stepResult.Status != stepSuccess && !step.ContinueOnError,
+	}
+}
+
+// Function to construct the reported result of a step from the result of its command. The output is
+// set separately since it depends on the output of the other steps.
+func newStepResult(name string, result commandResult, start, end time.Time) StepResult {
+	status := result.Status
+	if result.Timeout {
+		status = stepTimeout
+	}
+
+	return StepResult{
+		Name:       name,
+		Status:     status,
+		StatusCode: result.StatusCode,
+		IsTimeout:  result.Timeout,
+		Attempts:   1,
+		StartTime:  start.UnixNano() / 1000000,
+		EndTime:    end.UnixNano() / 1000000,
+	}
+}
+
+// Function to set the output of the step, fitted in the given number of bytes.
+func (r *StepResult) setOutput(stdout, stderr string, stdoutLimit, stderrLimit int) {
+	output := encodeOutput(stdout, stdoutLimit)
+	r.Output = output.Text
+	r.OutputEncoding = output.Encoding
+	r.OutputTruncated = output.Truncated
+
+	failureReason := encodeOutput(stderr, stderrLimit)
+	r.FailureReason = failureReason.Text
+	r.FailureReasonEncoding = failureReason.Encoding
+	r.FailureReasonTruncated = failureReason.Truncated
+}
+
+// Function to combine the results of the steps, in the order they are listed in the manifest. The steps
+// share the output budget of the action output message, so that a manifest reports no more output than
+// a plain runbook. The combined output is kept for the execution record and the rollback runbook.
+func manifestResult(manifest *RunbookManifest, states map[string]*stepState) commandResult {
+	result := commandResult{Status: stepSuccess}
+	var stdout, stderr bytes.Buffer
+	failed := false
+
+	ran := []*stepState{}
+	for _, step := range manifest.Steps {
+		if state, ok := states[step.Name]; ok {
+			ran = append(ran, state)
+		}
+	}
+	stdoutSizes, stderrSizes := make([]int, len(ran)), make([]int, len(ran))
+	for i, state := range ran {
+		stdoutSizes[i], stderrSizes[i] = len(state.stdout), len(state.stderr)
+	}
+	stdoutLimits := splitOutputBudget(stdoutSizes, maxOutputSize())
+	stderrLimits := splitOutputBudget(stderrSizes, maxOutputSize())
+
+	for i, state := range ran {
+		step := state.step
+		state.result.setOutput(state.stdout, state.stderr, stdoutLimits[i], stderrLimits[i])
+		result.Steps = append(result.Steps, state.result)
+
+		fmt.Fprintf(&stdout, "==> %s: %s\n", step.Name, state.result.Status)
+		stdout.WriteString(state.stdout)
+		if len(state.stderr) > 0 {
+			fmt.Fprintf(&stderr, "==> %s\n", step.Name)
+			stderr.WriteString(state.stderr)
+		}
+
+		// A runbook which failed because a step ran out of time is reported with the status of that step.
+		if state.blocking && !failed {
+			failed = true
+			result.Status = stepFailed
+			if state.result.IsTimeout {
+				result.Status = stepTimeout
+			}
+			result.StatusCode = state.result.StatusCode
+			if result.StatusCode == 0 {
+				result.StatusCode = 1
+			}
+		}
+		if state.blocking && state.result.IsTimeout {
+			result.Timeout = true
+		}
+	}
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result
+}
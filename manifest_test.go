@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that invalid manifests are rejected and plain scripts are not taken for manifests.
+func TestParseRunbookManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			content: `{"steps": [{"name": "a", "run": "true"}, {"name": "b", "run": "true", "dependsOn": ["a"]}]}`,
+		},
+		{
+			name:    "plain script",
+			content: "echo {}",
+		},
+		{
+			name:    "duplicate names",
+			content: `{"steps": [{"name": "a", "run": "true"}, {"name": "a", "run": "false"}]}`,
+			wantErr: `Step "a" is defined more than once.`,
+		},
+		{
+			name:    "unknown dependency",
+			content: `{"steps": [{"name": "a", "run": "true", "dependsOn": ["b"]}]}`,
+			wantErr: `Step "a" depends on unknown step "b".`,
+		},
+		{
+			name: "cycle",
+			content: `{"steps": [{"name": "a", "run": "true", "dependsOn": ["c"]}, {"name": "b", "run": "true", "dependsOn": ["a"]},
+				{"name": "c", "run": "true", "dependsOn": ["b"]}]}`,
+			wantErr: "Steps have a dependency cycle",
+		},
+		{
+			name:    "dependency on itself",
+			content: `{"steps": [{"name": "a", "run": "true", "dependsOn": ["a"]}]}`,
+			wantErr: "Steps have a dependency cycle",
+		},
+		{
+			name:    "no steps",
+			content: `{"steps": []}`,
+			wantErr: "Runbook manifest has no steps.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRunbookManifest(test.content)
+			if len(test.wantErr) == 0 && err != nil {
+				t.Errorf("parseRunbookManifest() failed: %v", err)
+			}
+			if len(test.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("parseRunbookManifest() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// Test that the steps run in the order of their dependencies and that failures only fail the runbook
+// when the step isn't allowed to fail. Steps which time out are killed, so they have no exit code.
+func TestRunManifest(t *testing.T) {
+	dir := useTestWorkingDir(t)
+	orderFile := filepath.Join(dir, "order")
+	record := func(name string) string {
+		return "echo " + name + " >> " + orderFile
+	}
+
+	tests := []struct {
+		name         string
+		steps        []RunbookStep
+		timeout      int32
+		wantStatus   string
+		wantCode     int
+		wantTimeout  bool
+		wantOrder    string
+		wantStatuses []string
+	}{
+		{
+			name: "dependencies",
+			steps: []RunbookStep{
+				{Name: "c", Run: record("c"), DependsOn: []string{"b"}},
+				{Name: "b", Run: record("b"), DependsOn: []string{"a"}},
+				{Name: "a", Run: record("a")},
+			},
+			wantStatus:   stepSuccess,
+			wantOrder:    "a\nb\nc\n",
+			wantStatuses: []string{stepSuccess, stepSuccess, stepSuccess},
+		},
+		{
+			name: "failure allowed",
+			steps: []RunbookStep{
+				{Name: "a", Run: record("a") + "; exit 3", ContinueOnError: true},
+				{Name: "b", Run: record("b"), DependsOn: []string{"a"}},
+			},
+			wantStatus:   stepSuccess,
+			wantOrder:    "a\nb\n",
+			wantStatuses: []string{stepFailed, stepSuccess},
+		},
+		{
+			name: "failure",
+			steps: []RunbookStep{
+				{Name: "a", Run: record("a") + "; exit 3"},
+				{Name: "b", Run: record("b"), DependsOn: []string{"a"}},
+			},
+			wantStatus:   stepFailed,
+			wantCode:     3,
+			wantOrder:    "a\n",
+			wantStatuses: []string{stepFailed, stepSkipped},
+		},
+		{
+			name: "step timeout",
+			steps: []RunbookStep{
+				{Name: "a", Run: "sleep 10", Timeout: 1},
+				{Name: "b", Run: record("b"), DependsOn: []string{"a"}},
+			},
+			wantStatus:   stepTimeout,
+			wantCode:     -1,
+			wantTimeout:  true,
+			wantStatuses: []string{stepTimeout, stepSkipped},
+		},
+		{
+			name: "runbook timeout",
+			steps: []RunbookStep{
+				{Name: "a", Run: "sleep 10"},
+			},
+			timeout:      1,
+			wantStatus:   stepTimeout,
+			wantCode:     -1,
+			wantTimeout:  true,
+			wantStatuses: []string{stepTimeout},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(orderFile)
+
+			manifest := &RunbookManifest{Steps: test.steps}
+			if err := manifest.validate(); err != nil {
+				t.Fatalf("validate() failed: %v", err)
+			}
+			scripts := map[string]string{}
+			for _, step := range test.steps {
+				scripts[step.Name] = step.Run
+			}
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = 30
+			}
+			event := &Event{EventId: "manifest-test", Timeout: timeout}
+
+			result := runManifest(&RegistrationInfo{}, event, manifest, scripts, nil)
+			if result.Status != test.wantStatus || result.StatusCode != test.wantCode || result.Timeout != test.wantTimeout {
+				t.Errorf("runManifest() = %s, %d, %v, want %s, %d, %v", result.Status, result.StatusCode, result.Timeout,
+					test.wantStatus, test.wantCode, test.wantTimeout)
+			}
+
+			statuses := map[string]string{}
+			for _, step := range result.Steps {
+				statuses[step.Name] = step.Status
+			}
+			for i, step := range test.steps {
+				if statuses[step.Name] != test.wantStatuses[i] {
+					t.Errorf("status of step %s = %s, want %s", step.Name, statuses[step.Name], test.wantStatuses[i])
+				}
+			}
+
+			order, _ := ioutil.ReadFile(orderFile)
+			if string(order) != test.wantOrder {
+				t.Errorf("steps ran in order %q, want %q", order, test.wantOrder)
+			}
+		})
+	}
+}
+
+// Test that the steps share the output budget and the output of the steps isn't reported twice.
+func TestRunManifestOutput(t *testing.T) {
+	useTestWorkingDir(t)
+	oldConfig := outputConfig
+	defer func() { outputConfig = oldConfig }()
+	outputConfig = OutputConfig{Truncation: truncateHead, MaxSizeKB: 1}
+
+	manifest := &RunbookManifest{Steps: []RunbookStep{
+		{Name: "small", Run: "echo small"},
+		{Name: "large", Run: "head -c 5000 /dev/zero | tr '\\0' a"},
+	}}
+	scripts := map[string]string{"small": manifest.Steps[0].Run, "large": manifest.Steps[1].Run}
+	result := runManifest(&RegistrationInfo{}, &Event{EventId: "manifest-test", Timeout: 30}, manifest, scripts, nil)
+
+	total := 0
+	for _, step := range result.Steps {
+		total += len(step.Output)
+	}
+	if total > maxOutputSize() {
+		t.Errorf("steps report %d bytes of output, want at most %d", total, maxOutputSize())
+	}
+	if result.Steps[0].Output != "small\n" || !result.Steps[1].OutputTruncated {
+		t.Errorf("step outputs = %q, %v, want the small output whole and the large one truncated",
+			result.Steps[0].Output, result.Steps[1].OutputTruncated)
+	}
+
+	message := newActionOutputMessage(&RegistrationInfo{}, &Event{}, result)
+	if message.ActionOutput != "==> small: SUCCESS\n==> large: SUCCESS\n" {
+		t.Errorf("action output = %q, want the summary of the steps", message.ActionOutput)
+	}
+}
+
+// Function to run a test in a temp working directory, where runbooks are written.
+func useTestWorkingDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "runbooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := workingDir
+	workingDir = dir
+	t.Cleanup(func() {
+		workingDir = oldDir
+		os.RemoveAll(dir)
+	})
+	return dir
+}
@@ -0,0 +1,230 @@
+// Package metrics is responsible for the Prometheus metrics of the agent. The agent counts its SQS polls,
+// the messages it receives, releases and rejects, its executions, heartbeats and registrations, and
+// serves them along with a few gauges in the Prometheus text format. The metrics are served on an
+// optional TCP listener and through the control API.
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	metricsPath           = "/metrics"
+	defaultMetricsAddress = "127.0.0.1:9779"
+	metricsContentType    = "text/plain; version=0.0.4"
+
+	// Reasons for which messages are released back to SQS.
+	releasedOtherAgent = "other_agent"
+	releasedBlackout   = "blackout"
+
+	// Reasons for which messages are rejected.
+	rejectedMissingAttribute = "missing_attribute"
+	rejectedSignature        = "signature"
+	rejectedAgentIdMismatch  = "agent_id_mismatch"
+	rejectedStale            = "stale"
+	rejectedDuplicate        = "duplicate"
+	rejectedGithubOnly       = "github_only"
+
+	// Outcomes of the calls to Neptune.io.
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// Upper bounds of the buckets of the execution duration histogram, in seconds.
+var executionDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// Counter with at most one label. Values are kept by label value, which is empty without a label.
+type counter struct {
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+// Histogram without labels. Counts are per bucket, not cumulative.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Global variables to hold the metrics of the agent.
+var (
+	metricsLock sync.Mutex
+
+	sqsPolls         = &counter{name: "neptune_agent_sqs_polls_total", help: "SQS polls."}
+	sqsPollFailures  = &counter{name: "neptune_agent_sqs_poll_failures_total", help: "Failed SQS polls."}
+	messagesReceived = &counter{name: "neptune_agent_messages_received_total", help: "Messages received from SQS."}
+	messagesReleased = &counter{name: "neptune_agent_messages_released_total", help: "Messages released back to SQS by reason.", label: "reason"}
+	messagesRejected = &counter{name: "neptune_agent_messages_rejected_total", help: "Messages rejected by reason.", label: "reason"}
+	executions       = &counter{name: "neptune_agent_executions_total", help: "Finished executions by status.", label: "status"}
+	heartbeats       = &counter{name: "neptune_agent_heartbeats_total", help: "Heartbeats by outcome.", label: "outcome"}
+	registrations    = &counter{name: "neptune_agent_registrations_total", help: "Registrations by outcome.", label: "outcome"}
+
+	executionDuration = &histogram{name: "neptune_agent_execution_duration_seconds", help: "Duration of finished executions.",
+		buckets: executionDurationBuckets, counts: make([]uint64, len(executionDurationBuckets))}
+
+	allCounters = []*counter{sqsPolls, sqsPollFailures, messagesReceived, messagesReleased, messagesRejected,
+		executions, heartbeats, registrations}
+
+	// Channel of the action outputs waiting to be sent to Neptune.io.
+	outbox chan<- *ActionOutputMessage
+)
+
+// Function to start serving the metrics on the configured address, if enabled in agent config. The given
+// channel of action outputs is measured as the outbox.
+func StartMetrics(config MetricsConfig, actionOutputs chan<- *ActionOutputMessage) error {
+	metricsLock.Lock()
+	outbox = actionOutputs
+	metricsLock.Unlock()
+
+	if !config.Enabled {
+		return nil
+	}
+	if len(config.Address) == 0 {
+		config.Address = defaultMetricsAddress
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, serveMetrics)
+	server := &http.Server{Handler: mux}
+
+	// Listen right away so that errors like a busy port are reported to the caller.
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+	logging.Info("Started serving the metrics.", logging.Fields{"address": config.Address})
+	go func() {
+		logging.Error("Metrics server stopped.", logging.Fields{"error": server.Serve(listener)})
+	}()
+	return nil
+}
+
+// Function to add to the counter, under the given label value if it has a label.
+func (c *counter) add(labelValue string, delta float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[labelValue] += delta
+}
+
+func (c *counter) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (h *histogram) observe(value float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Function to count a finished execution.
+func observeExecution(start time.Time, result commandResult) {
+	executions.inc(result.Status)
+	executionDuration.observe(time.Since(start).Seconds())
+}
+
+// Function to count the outcome of a call to Neptune.io.
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(renderMetrics())
+}
+
+// Function to render all the metrics in the Prometheus text format.
+func renderMetrics() []byte {
+	inflightCount := len(InflightExecutions())
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range allCounters {
+		writeMetricHeader(&buf, c.name, c.help, "counter")
+		if len(c.label) == 0 {
+			fmt.Fprintf(&buf, "%s %s\n", c.name, formatMetricValue(c.values[""]))
+			continue
+		}
+		labelValues := make([]string, 0, len(c.values))
+		for v := range c.values {
+			labelValues = append(labelValues, v)
+		}
+		sort.Strings(labelValues)
+		for _, v := range labelValues {
+			fmt.Fprintf(&buf, "%s{%s=\"%s\"} %s\n", c.name, c.label, escapeLabelValue(v), formatMetricValue(c.values[v]))
+		}
+	}
+
+	h := executionDuration
+	writeMetricHeader(&buf, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(&buf, "%s_bucket{le=\"%s\"} %d\n", h.name, formatMetricValue(bound), cumulative)
+	}
+	fmt.Fprintf(&buf, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(&buf, "%s_sum %s\n", h.name, formatMetricValue(h.sum))
+	fmt.Fprintf(&buf, "%s_count %d\n", h.name, h.count)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"neptune_agent_outbox_depth", "Action outputs waiting to be sent to Neptune.io.", len(outbox)},
+		{"neptune_agent_errors_backlog", "Agent errors waiting to be sent to Neptune.io.", len(ErrorsChannel)},
+		{"neptune_agent_inflight_executions", "Executions running right now.", inflightCount},
+	}
+	for _, g := range gauges {
+		writeMetricHeader(&buf, g.name, g.help, "gauge")
+		fmt.Fprintf(&buf, "%s %d\n", g.name, g.value)
+	}
+	return buf.Bytes()
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
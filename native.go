@@ -0,0 +1,625 @@
+// Package native is responsible for the native actions, which the agent implements itself instead of
+// running a shell script: HTTP requests, TCP probes, tailing files, disk usage, listing and killing
+// processes, and reading or writing files with checksums. An event picks a native action with its
+// action type and passes its parameters as JSON. Native actions return a structured result, and can be
+// allowed even when shell scripts are disabled by policy. File actions are limited to the allowed paths,
+// HTTP requests to the allowed hosts and killing processes to the allowed process names.
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Action types of the native actions.
+	httpRequestAction = "http_request"
+	tcpProbeAction    = "tcp_probe"
+	fileTailAction    = "file_tail"
+	diskUsageAction   = "disk_usage"
+	processListAction = "process_list"
+	processKillAction = "process_kill"
+	fileReadAction    = "file_read"
+	fileWriteAction   = "file_write"
+
+	defaultNativeActionTimeout = 30 * time.Second
+	defaultTailLines           = 100
+	maxHttpRedirects           = 10
+
+	// Limits on how much a native action reads so that it can't exhaust the agent's memory.
+	maxHttpResponseBytes = 1024 * 1024
+	maxTailBytes         = 4 * 1024 * 1024
+	maxFileReadBytes     = 1024 * 1024
+)
+
+// Native action run with the parameters of an event. Returns the structured result and the output,
+// along with an error if the action failed. The result is reported even if the action failed.
+type nativeAction func(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error)
+
+var nativeActions = map[string]nativeAction{
+	httpRequestAction: httpRequest,
+	tcpProbeAction:    tcpProbe,
+	fileTailAction:    fileTail,
+	diskUsageAction:   diskUsageReport,
+	processListAction: processList,
+	processKillAction: processKill,
+	fileReadAction:    fileRead,
+	fileWriteAction:   fileWrite,
+}
+
+// Parameters of the native actions.
+type httpRequestParams struct {
+	URL            string            `json:"url"`
+	Method         string            `json:"method"`
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	ExpectedStatus int               `json:"expectedStatus"`
+}
+
+type tcpProbeParams struct {
+	Address string `json:"address"`
+}
+
+type fileTailParams struct {
+	Path    string `json:"path"`
+	Lines   int    `json:"lines"`
+	Pattern string `json:"pattern"`
+}
+
+type diskUsageParams struct {
+	Path string `json:"path"`
+}
+
+type processListParams struct {
+	Pattern string `json:"pattern"`
+}
+
+type processKillParams struct {
+	Name  string `json:"name"`
+	Force bool   `json:"force"`
+}
+
+type fileReadParams struct {
+	Path string `json:"path"`
+}
+
+// Content is base64 encoded if Encoding is "base64". If SHA256 is set, the content is only written if
+// it has that checksum. Mode is an octal permission like "0644" and defaults to the existing file's.
+type fileWriteParams struct {
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+	SHA256   string `json:"sha256"`
+	Mode     string `json:"mode"`
+}
+
+// Global variable to hold the native action settings.
+var nativeConfig NativeActionsConfig
+
+// Function to initialize the native action settings from agent config. The allowed paths are made
+// absolute, with symlinks resolved, so that they can be compared with the paths of file actions.
+func InitializeNativeActions(config NativeActionsConfig) {
+	allowed := []string{}
+	for _, path := range config.AllowedPaths {
+		resolved, err := resolvePath(path)
+		if err != nil {
+			logging.Warn("Ignoring invalid allowed path.", logging.Fields{"path": path, "error": err})
+			continue
+		}
+		allowed = append(allowed, resolved)
+	}
+	config.AllowedPaths = allowed
+	for i, host := range config.AllowedHosts {
+		config.AllowedHosts[i] = strings.ToLower(host)
+	}
+	nativeConfig = config
+	logging.Info("Initialized native actions.", logging.Fields{"disableScripts": config.DisableScripts,
+		"allowedPaths": config.AllowedPaths, "allowedHosts": config.AllowedHosts,
+		"allowedProcessNames": config.AllowedProcessNames, "disabled": config.Disabled})
+}
+
+// Function to check if the given action type is a native action.
+func isNativeAction(actionType string) bool {
+	_, ok := nativeActions[actionType]
+	return ok
+}
+
+// Function to run the native action of the given event and report its result. Native actions run once,
+// without the locks, health checks and retries of runbooks.
+func executeNativeAction(regInfo *RegistrationInfo, event *Event, actionOutputs chan<- *ActionOutputMessage) error {
+	logging.Info("Running native action.", logging.Fields{"eventId": event.EventId, "action": event.ActionType})
+	DeleteMessage(regInfo, &event.ReceiptHandle)
+
+	// Persist the event so that we don't rerun the action for this event again.
+	if err := PersistEvent(event); err != nil {
+		logging.Error("Could not persist the event.", logging.Fields{"error": err})
+	}
+
+	timeout := defaultNativeActionTimeout
+	if event.Timeout > 0 {
+		timeout = time.Duration(event.Timeout) * time.Second
+	}
+
+	record := newExecutionRecord(event, "", "", nil, nil)
+	start := time.Now()
+	var actionResult *ActionResult
+	var out []byte
+	var err error
+	if containsString(nativeConfig.Disabled, event.ActionType) {
+		err = fmt.Errorf("Native action %s is disabled on this agent.", event.ActionType)
+	} else {
+		actionResult, out, err = nativeActions[event.ActionType](event.Params, timeout)
+	}
+
+	result := commandResult{Status: "SUCCESS", StatusCode: 0, Stdout: string(out), Result: actionResult, Attempt: 1}
+	if err != nil {
+		result.Status = "FAILED"
+		result.StatusCode = 1
+		result.Stderr = err.Error()
+	}
+	if actionResult != nil {
+		if e := actionResult.validate(); e != nil {
+			logging.Warn("Native action returned an invalid result.", logging.Fields{"eventId": event.EventId, "error": e})
+			result.Result = nil
+		}
+	}
+
+	record.finish(result)
+	recordExecution(event, start, result)
+	recordBreakerResult(event.RuleId, result.Status != "SUCCESS")
+	return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+}
+
+// Function to decode the parameters of a native action, rejecting unknown ones so that typos don't go
+// unnoticed.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Invalid parameters: %v", err)
+	}
+	return nil
+}
+
+// Function to get the absolute path of the given path with symlinks resolved. A path which doesn't exist
+// yet is resolved through its directory.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// Function to check that a file action may access the given path. Returns the resolved path.
+func allowedPath(path string) (string, error) {
+	if len(path) == 0 {
+		return "", errors.New("Path is required.")
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, allowed := range nativeConfig.AllowedPaths {
+		if resolved == allowed || strings.HasPrefix(resolved, strings.TrimSuffix(allowed, string(filepath.Separator))+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("Path %s is not within the allowed paths of this agent.", path)
+}
+
+// Function to check that an HTTP request may be sent to the given URL. Either the host or the host and
+// port of the URL must be allowed.
+func allowedURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	if containsString(nativeConfig.AllowedHosts, host) || containsString(nativeConfig.AllowedHosts, strings.ToLower(u.Host)) {
+		return nil
+	}
+	return fmt.Errorf("Host %s is not within the allowed hosts of this agent.", u.Host)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func httpRequest(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p httpRequestParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, nil, fmt.Errorf("URL %q is not an absolute http(s) URL.", p.URL)
+	}
+	if err := allowedURL(u); err != nil {
+		return nil, nil, err
+	}
+	if len(p.Method) == 0 {
+		p.Method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(p.Method), p.URL, strings.NewReader(p.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	// Redirects must stay within the allowed hosts too. The headers given with the request may carry
+	// credentials, so they aren't sent on to another host.
+	client := &http.Client{Timeout: timeout, CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if len(via) >= maxHttpRedirects {
+			return fmt.Errorf("Stopped after %d redirects.", maxHttpRedirects)
+		}
+		if !strings.EqualFold(r.URL.Host, u.Host) {
+			for k := range p.Headers {
+				r.Header.Del(k)
+			}
+		}
+		return allowedURL(r.URL)
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHttpResponseBytes+1))
+	latency := time.Since(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	truncated := len(body) > maxHttpResponseBytes
+	if truncated {
+		body = body[:maxHttpResponseBytes]
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("%s %s returned %d.", req.Method, u.Host, resp.StatusCode),
+		Facts: map[string]string{"status": strconv.Itoa(resp.StatusCode), "contentType": resp.Header.Get("Content-Type"),
+			"truncated": strconv.FormatBool(truncated)},
+		Metrics: map[string]float64{"latencyMs": float64(latency / time.Millisecond), "bodyBytes": float64(len(body))},
+	}
+	if p.ExpectedStatus > 0 && resp.StatusCode != p.ExpectedStatus {
+		return result, body, fmt.Errorf("Got status %d instead of %d.", resp.StatusCode, p.ExpectedStatus)
+	} else if p.ExpectedStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return result, body, fmt.Errorf("Got unsuccessful status %d.", resp.StatusCode)
+	}
+	return result, body, nil
+}
+
+func tcpProbe(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p tcpProbeParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return nil, nil, fmt.Errorf("Invalid address. %v", err)
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", p.Address, timeout)
+	latency := time.Since(start)
+	result := &ActionResult{
+		Facts:   map[string]string{"address": p.Address, "connected": strconv.FormatBool(err == nil)},
+		Metrics: map[string]float64{"latencyMs": float64(latency / time.Millisecond)},
+	}
+	if err != nil {
+		result.Summary = "Could not connect to " + p.Address + "."
+		return result, nil, err
+	}
+	conn.Close()
+	result.Summary = "Connected to " + p.Address + "."
+	return result, nil, nil
+}
+
+// Function to get the last lines of a file, optionally only the ones matching a pattern. Only the end of
+// a large file is searched.
+func fileTail(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p fileTailParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	path, err := allowedPath(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Lines <= 0 {
+		p.Lines = defaultTailLines
+	}
+	var pattern *regexp.Regexp
+	if len(p.Pattern) > 0 {
+		if pattern, err = regexp.Compile(p.Pattern); err != nil {
+			return nil, nil, fmt.Errorf("Invalid pattern. %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := info.Size() - maxTailBytes
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lines := []string{}
+	scanned := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxTailBytes)
+	for scanner.Scan() {
+		// The first line is likely cut in the middle if reading didn't start at the beginning.
+		if offset > 0 && scanned == 0 {
+			scanned++
+			continue
+		}
+		scanned++
+		line := scanner.Text()
+		if pattern != nil && !pattern.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) > p.Lines {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Got %d lines of %s.", len(lines), p.Path),
+		Metrics: map[string]float64{"lines": float64(len(lines)), "sizeBytes": float64(info.Size())},
+	}
+	out := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		out += "\n"
+	}
+	return result, []byte(out), nil
+}
+
+func diskUsageReport(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p diskUsageParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	if len(p.Path) == 0 {
+		p.Path = "/"
+		if runtime.GOOS == "windows" {
+			p.Path = filepath.VolumeName(workingDir) + `\`
+		}
+	}
+
+	total, free, available, err := diskUsage(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	usedPercent := 0.0
+	if total > 0 {
+		usedPercent = float64(total-free) * 100 / float64(total)
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Filesystem of %s is %.1f%% used.", p.Path, usedPercent),
+		Facts:   map[string]string{"path": p.Path},
+		Metrics: map[string]float64{"totalBytes": float64(total), "freeBytes": float64(free),
+			"availableBytes": float64(available), "usedPercent": usedPercent},
+	}
+	out, err := json.MarshalIndent(result.Metrics, "", "  ")
+	return result, out, err
+}
+
+func processList(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p processListParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, nil, err
+	}
+	matching := []processInfo{}
+	for _, process := range processes {
+		if strings.Contains(process.Command, p.Pattern) {
+			matching = append(matching, process)
+		}
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Found %d processes.", len(matching)),
+		Metrics: map[string]float64{"processes": float64(len(matching))},
+	}
+	out, err := json.MarshalIndent(matching, "", "  ")
+	return result, out, err
+}
+
+// Function to stop the processes whose executable has the given name. The agent never stops itself.
+func processKill(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p processKillParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	if len(p.Name) == 0 {
+		return nil, nil, errors.New("Process name is required.")
+	}
+	if !containsString(nativeConfig.AllowedProcessNames, p.Name) {
+		return nil, nil, fmt.Errorf("Process %s is not within the allowed process names of this agent.", p.Name)
+	}
+
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, nil, err
+	}
+	killed := []string{}
+	failures := []string{}
+	for _, process := range processes {
+		if process.name() != p.Name || process.Pid == os.Getpid() {
+			continue
+		}
+		if err := terminateProcess(process.Pid, p.Force); err != nil {
+			failures = append(failures, fmt.Sprintf("%d: %v", process.Pid, err))
+			continue
+		}
+		killed = append(killed, strconv.Itoa(process.Pid))
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Stopped %d processes named %s.", len(killed), p.Name),
+		Facts:   map[string]string{"pids": strings.Join(killed, ",")},
+		Metrics: map[string]float64{"stopped": float64(len(killed)), "failed": float64(len(failures))},
+	}
+	if len(failures) > 0 {
+		return result, nil, errors.New("Could not stop some processes. " + strings.Join(failures, "; "))
+	}
+	if len(killed) == 0 {
+		return result, nil, fmt.Errorf("No process named %s is running.", p.Name)
+	}
+	return result, nil, nil
+}
+
+// Function to read a file along with its checksum. The checksum covers the whole file even if only its
+// beginning is returned.
+func fileRead(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p fileReadParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	path, err := allowedPath(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var content bytes.Buffer
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(hash, &limitedBuffer{buf: &content, limit: maxFileReadBytes}), f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Read %s.", p.Path),
+		Facts:   map[string]string{"sha256": hex.EncodeToString(hash.Sum(nil)), "truncated": strconv.FormatBool(size > maxFileReadBytes)},
+		Metrics: map[string]float64{"sizeBytes": float64(size)},
+	}
+	return result, content.Bytes(), nil
+}
+
+// Writer keeping only the first bytes written to it, up to the limit.
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); room > 0 {
+		if len(p) > room {
+			l.buf.Write(p[:room])
+		} else {
+			l.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Function to replace a file with the given content, verifying its checksum first.
+func fileWrite(params json.RawMessage, timeout time.Duration) (*ActionResult, []byte, error) {
+	var p fileWriteParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, nil, err
+	}
+	path, err := allowedPath(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content := []byte(p.Content)
+	switch p.Encoding {
+	case "":
+	case "base64":
+		if content, err = base64.StdEncoding.DecodeString(p.Content); err != nil {
+			return nil, nil, fmt.Errorf("Content is not valid base64. %v", err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unknown content encoding %q.", p.Encoding)
+	}
+
+	checksum := sha256Hex(content)
+	if len(p.SHA256) > 0 && !strings.EqualFold(p.SHA256, checksum) {
+		return nil, nil, fmt.Errorf("Content has checksum %s instead of %s.", checksum, p.SHA256)
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if len(p.Mode) > 0 {
+		m, err := strconv.ParseUint(p.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, nil, fmt.Errorf("Invalid mode %q.", p.Mode)
+		}
+		mode = os.FileMode(m)
+	}
+
+	err = replaceFile(path, func(f *os.File) error {
+		if _, err := f.Write(content); err != nil {
+			return err
+		}
+		return f.Chmod(mode)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &ActionResult{
+		Summary: fmt.Sprintf("Wrote %s.", p.Path),
+		Facts:   map[string]string{"sha256": checksum},
+		Metrics: map[string]float64{"sizeBytes": float64(len(content))},
+	}
+	return result, nil, nil
+}
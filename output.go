@@ -0,0 +1,157 @@
+// Package output is responsible for fitting the runbook output into the action output message.
+// Outputs are redacted, large outputs are truncated using the configured strategy without splitting
+// UTF-8 characters, and binary outputs are base64 encoded.
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Truncation strategies for runbook output larger than the maximum size.
+	truncateHead     = "head"
+	truncateTail     = "tail"
+	truncateHeadTail = "headtail"
+
+	// By default we keep the first and last 1MB of the runbook output.
+	defaultMaxOutputSizeKB = 2 * 1024
+	defaultTruncation      = truncateHeadTail
+
+	base64Encoding = "base64"
+)
+
+// Global variable to hold the output truncation settings.
+var outputConfig = OutputConfig{Truncation: defaultTruncation, MaxSizeKB: defaultMaxOutputSizeKB}
+
+// Runbook output fitted into the action output message. Size is the byte count of the original output.
+type encodedOutput struct {
+	Text      string
+	Encoding  string
+	Size      int
+	Truncated bool
+}
+
+// Function to initialize the output truncation settings from agent config.
+func InitializeOutput(config OutputConfig) {
+	switch config.Truncation {
+	case truncateHead, truncateTail, truncateHeadTail:
+	default:
+		if len(config.Truncation) > 0 {
+			logging.Warn("Unknown output truncation strategy. Using the default.", logging.Fields{"truncation": config.Truncation})
+		}
+		config.Truncation = defaultTruncation
+	}
+
+	if config.MaxSizeKB <= 0 {
+		config.MaxSizeKB = defaultMaxOutputSizeKB
+	}
+	outputConfig = config
+}
+
+// Function to get the maximum size of an output in the action output message.
+func maxOutputSize() int {
+	return outputConfig.MaxSizeKB * 1024
+}
+
+// Function to redact, truncate and encode the runbook output to fit in the given number of bytes. This
+// is the only place where the outputs are redacted. It happens before truncating so that a secret cut in
+// half doesn't escape the redaction.
+func encodeOutput(output string, limit int) encodedOutput {
+	result := encodedOutput{Size: len(output)}
+	data := []byte(logging.Redact(output))
+
+	// Anything which isn't valid UTF-8 text is treated as binary and base64 encoded.
+	binary := !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0
+	if binary {
+		limit = limit / 4 * 3
+	}
+
+	if len(data) > limit {
+		data = truncateOutput(data, limit, outputConfig.Truncation, !binary)
+		result.Truncated = true
+	}
+
+	if binary {
+		result.Text = base64.StdEncoding.EncodeToString(data)
+		result.Encoding = base64Encoding
+	} else {
+		result.Text = string(data)
+	}
+	return result
+}
+
+// Function to split the output budget between outputs of the given sizes. Outputs smaller than their
+// share get all they need and leave the rest to the larger ones.
+func splitOutputBudget(sizes []int, budget int) []int {
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return sizes[order[a]] < sizes[order[b]] })
+
+	limits := make([]int, len(sizes))
+	for n, i := range order {
+		share := budget / (len(sizes) - n)
+		if sizes[i] < share {
+			share = sizes[i]
+		}
+		limits[i] = share
+		budget -= share
+	}
+	return limits
+}
+
+// Function to truncate the data to the given limit using the given strategy. Cut points are moved to
+// the UTF-8 character boundaries if the data is text.
+func truncateOutput(data []byte, limit int, strategy string, text bool) []byte {
+	switch strategy {
+	case truncateHead:
+		return data[:headCut(data, limit, text)]
+
+	case truncateTail:
+		return data[tailCut(data, len(data)-limit, text):]
+
+	default:
+		// Leave room for the marker assuming the largest possible number of truncated bytes.
+		markerSize := len(truncationMarker(len(data)))
+		if limit <= markerSize {
+			return data[:headCut(data, limit, text)]
+		}
+
+		half := (limit - markerSize) / 2
+		head := data[:headCut(data, half, text)]
+		tail := data[tailCut(data, len(data)-half, text):]
+		marker := truncationMarker(len(data) - len(head) - len(tail))
+
+		truncated := make([]byte, 0, len(head)+len(marker)+len(tail))
+		truncated = append(truncated, head...)
+		truncated = append(truncated, marker...)
+		return append(truncated, tail...)
+	}
+}
+
+func truncationMarker(numBytes int) string {
+	return fmt.Sprintf("\n\n... [%d bytes truncated] ...\n\n", numBytes)
+}
+
+// Helper function to move the end of the head back to a character boundary.
+func headCut(data []byte, i int, text bool) int {
+	for text && i > 0 && !utf8.RuneStart(data[i]) {
+		i--
+	}
+	return i
+}
+
+// Helper function to move the start of the tail forward to a character boundary.
+func tailCut(data []byte, i int, text bool) int {
+	for text && i < len(data) && !utf8.RuneStart(data[i]) {
+		i++
+	}
+	return i
+}
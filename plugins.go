@@ -0,0 +1,300 @@
+// Package plugins is responsible for the action plugins, which let users add their own action types
+// without changing the agent. A plugin is an executable in the plugins directory which speaks JSON over
+// its stdin and stdout. When the agent starts, it asks every plugin for its capabilities, that is, the
+// action types it handles. An event of one of those action types is then run by the plugin, with the
+// same timeout, kill and output handling as a runbook.
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Version of the plugin protocol spoken by this agent.
+	pluginProtocolVersion = 1
+
+	// Types of the requests sent to plugins.
+	capabilitiesRequest = "capabilities"
+	executeRequest      = "execute"
+
+	defaultPluginsDir                    = "plugins"
+	defaultPluginHandshakeTimeoutSeconds = 10
+	defaultPluginTimeoutSeconds          = 300
+)
+
+// Request written to the stdin of a plugin. Capabilities requests only have the type and the version.
+type PluginRequest struct {
+	Type             string            `json:"type"`
+	ProtocolVersion  int               `json:"protocolVersion"`
+	ActionType       string            `json:"actionType,omitempty"`
+	EventId          string            `json:"eventId,omitempty"`
+	RuleId           string            `json:"ruleId,omitempty"`
+	RuleName         string            `json:"ruleName,omitempty"`
+	Hostname         string            `json:"hostname,omitempty"`
+	InflightActionId string            `json:"inflightActionId,omitempty"`
+	Timeout          int32             `json:"timeout,omitempty"`
+	Params           json.RawMessage   `json:"params,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+}
+
+// Capabilities of a plugin, returned on its stdout for a capabilities request, and reported when the
+// agent registers.
+type PluginInfo struct {
+	Name            string   `json:"name"`
+	Version         string   `json:"version"`
+	ProtocolVersion int      `json:"protocolVersion"`
+	ActionTypes     []string `json:"actionTypes"`
+}
+
+// Response of a plugin for an execute request. Status is "SUCCESS" or "FAILED".
+type PluginResponse struct {
+	Status string        `json:"status"`
+	Output string        `json:"output"`
+	Error  string        `json:"error"`
+	Result *ActionResult `json:"result"`
+}
+
+// Plugin found in the plugins directory.
+type actionPlugin struct {
+	path string
+	info PluginInfo
+}
+
+// Global variables to hold the plugins by the action types they handle.
+var pluginsConfig PluginsConfig
+var actionPlugins = map[string]*actionPlugin{}
+var loadedPlugins []PluginInfo
+
+// Function to discover the plugins in the configured directory, or in the "plugins" directory under the
+// given one, and ask them for their capabilities. Plugins which fail the handshake are skipped, and an
+// action type is handled by the first plugin claiming it.
+func InitializePlugins(config PluginsConfig, dir string) {
+	config.Dir = absPath(dir, config.Dir)
+	if len(config.Dir) == 0 {
+		config.Dir = filepath.Join(dir, defaultPluginsDir)
+	}
+	if config.HandshakeTimeoutSeconds <= 0 {
+		config.HandshakeTimeoutSeconds = defaultPluginHandshakeTimeoutSeconds
+	}
+	pluginsConfig = config
+	actionPlugins = map[string]*actionPlugin{}
+	loadedPlugins = nil
+
+	entries, err := ioutil.ReadDir(config.Dir)
+	if os.IsNotExist(err) {
+		logging.Debug("No plugins directory.", logging.Fields{"dir": config.Dir})
+		return
+	} else if err != nil {
+		logging.Warn("Could not list the plugins.", logging.Fields{"error": err, "dir": config.Dir})
+		return
+	}
+
+	for _, entry := range entries {
+		if !isPluginExecutable(entry) {
+			continue
+		}
+		path := filepath.Join(config.Dir, entry.Name())
+		info, err := pluginCapabilities(path)
+		if err != nil {
+			logging.Warn("Ignoring the plugin which failed the handshake.", logging.Fields{"plugin": path, "error": err})
+			continue
+		}
+
+		plugin := &actionPlugin{path: path, info: *info}
+		claimed := []string{}
+		for _, actionType := range info.ActionTypes {
+			if isNativeAction(actionType) {
+				logging.Warn("Plugin can't handle a native action type.", logging.Fields{"plugin": info.Name, "actionType": actionType})
+			} else if other, ok := actionPlugins[actionType]; ok {
+				logging.Warn("Action type is already handled by another plugin.", logging.Fields{"plugin": info.Name,
+					"actionType": actionType, "other": other.info.Name})
+			} else {
+				actionPlugins[actionType] = plugin
+				claimed = append(claimed, actionType)
+			}
+		}
+		plugin.info.ActionTypes = claimed
+		loadedPlugins = append(loadedPlugins, plugin.info)
+		logging.Info("Loaded plugin.", logging.Fields{"plugin": info.Name, "version": info.Version, "actionTypes": claimed})
+	}
+}
+
+// Function to check if the directory entry can be run as a plugin. On windows the extension tells if
+// a file is executable, elsewhere the mode does.
+func isPluginExecutable(entry os.FileInfo) bool {
+	if !entry.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".exe", ".cmd", ".bat":
+			return true
+		}
+		return false
+	}
+	return entry.Mode().Perm()&0111 != 0
+}
+
+// Function to get the plugins loaded from the plugins directory, to be reported on registration.
+func listPlugins() []PluginInfo {
+	return loadedPlugins
+}
+
+// Function to check if the given action type is handled by a plugin.
+func isPluginAction(actionType string) bool {
+	_, ok := actionPlugins[actionType]
+	return ok
+}
+
+// Function to ask the plugin at the given path for its capabilities.
+func pluginCapabilities(path string) (*PluginInfo, error) {
+	request := PluginRequest{Type: capabilitiesRequest, ProtocolVersion: pluginProtocolVersion}
+	result, err := runPlugin(path, request, nil, time.Duration(pluginsConfig.HandshakeTimeoutSeconds)*time.Second, nil)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status != "SUCCESS" {
+		return nil, fmt.Errorf("Plugin exited with status %s and code %d. %s", result.Status, result.StatusCode, result.Stderr)
+	}
+
+	var info PluginInfo
+	if err := json.Unmarshal([]byte(result.Stdout), &info); err != nil {
+		return nil, fmt.Errorf("Plugin returned invalid capabilities. %v", err)
+	}
+	if len(info.Name) == 0 {
+		info.Name = filepath.Base(path)
+	}
+	if info.ProtocolVersion != pluginProtocolVersion {
+		return nil, fmt.Errorf("Plugin speaks protocol version %d instead of %d.", info.ProtocolVersion, pluginProtocolVersion)
+	}
+	if len(info.ActionTypes) == 0 {
+		return nil, errors.New("Plugin doesn't handle any action type.")
+	}
+	sort.Strings(info.ActionTypes)
+	return &info, nil
+}
+
+// Function to run the plugin at the given path with the request on its stdin, killing it if it doesn't
+// finish within the timeout.
+func runPlugin(path string, request PluginRequest, env []string, timeout time.Duration, started func(pid int) func()) (commandResult, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return commandResult{}, err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	return runCommand(cmd, timeout, nil, "", started), nil
+}
+
+// Function to run the plugin handling the action type of the given event and report its result. Like
+// native actions, plugin actions run once, without the locks, health checks and retries of runbooks.
+func executePluginAction(regInfo *RegistrationInfo, event *Event, actionOutputs chan<- *ActionOutputMessage) error {
+	plugin := actionPlugins[event.ActionType]
+	logging.Info("Running plugin action.", logging.Fields{"eventId": event.EventId, "action": event.ActionType, "plugin": plugin.info.Name})
+
+	// The secrets are passed to the plugin in the environment, just like to runbooks.
+	secrets, err := resolveSecrets(event.Secrets)
+	if err != nil {
+		return failEvent(regInfo, event, actionOutputs, err.Error())
+	}
+
+	// Persist the event so that we don't rerun the action for this event again.
+	if err := PersistEvent(event); err != nil {
+		logging.Error("Could not persist the event.", logging.Fields{"error": err})
+	}
+
+	timeout := event.Timeout
+	if timeout <= 0 {
+		timeout = defaultPluginTimeoutSeconds
+	}
+	request := PluginRequest{
+		Type:             executeRequest,
+		ProtocolVersion:  pluginProtocolVersion,
+		ActionType:       event.ActionType,
+		EventId:          event.EventId,
+		RuleId:           event.RuleId,
+		RuleName:         event.RuleName,
+		Hostname:         event.Hostname,
+		InflightActionId: event.InflightActionId,
+		Timeout:          timeout,
+		Params:           event.Params,
+		Env:              event.Environment,
+	}
+
+	record := newExecutionRecord(event, "", "", nil, secrets)
+	start := time.Now()
+	result, err := runPlugin(plugin.path, request, commandEnv(event, secrets), time.Duration(timeout)*time.Second, actionStarted(regInfo, event))
+	if err != nil {
+		DeleteMessage(regInfo, &event.ReceiptHandle)
+		result = commandResult{Status: "FAILED", StatusCode: 1, Stderr: err.Error()}
+	} else {
+		result = pluginResult(result)
+	}
+	if isCancelled(event.EventId) {
+		markCancelled(&result)
+	}
+	result.Attempt = 1
+
+	record.finish(result)
+	recordExecution(event, start, result)
+	recordBreakerResult(event.RuleId, result.Status != "SUCCESS")
+	return sendActionOutput(actionOutputs, newActionOutputMessage(regInfo, event, result))
+}
+
+// Function to turn the output of a plugin process into the result of its action. The stderr of the
+// plugin is kept in the failure reason, followed by the error the plugin reported.
+func pluginResult(process commandResult) commandResult {
+	if process.Timeout {
+		return process
+	}
+
+	var response PluginResponse
+	if err := json.Unmarshal([]byte(process.Stdout), &response); err != nil {
+		process.Status = "FAILED"
+		process.StatusCode = 1
+		process.Stderr = appendLine(process.Stderr, "Plugin returned an invalid response. "+err.Error())
+		return process
+	}
+
+	result := commandResult{Status: "SUCCESS", StatusCode: process.StatusCode, Stdout: response.Output,
+		Stderr: appendLine(process.Stderr, response.Error), Result: response.Result}
+	if process.Status != "SUCCESS" || response.Status != "SUCCESS" {
+		result.Status = "FAILED"
+		if result.StatusCode == 0 {
+			result.StatusCode = 1
+		}
+	}
+	if result.Result != nil {
+		if err := result.Result.validate(); err != nil {
+			result.Result = nil
+			result.Stderr = appendLine(result.Stderr, "Plugin returned an invalid result. "+err.Error())
+		}
+	}
+	return result
+}
+
+func appendLine(text, line string) string {
+	if len(line) == 0 {
+		return text
+	}
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text + line
+}
@@ -0,0 +1,112 @@
+// Package util contains the utility code used in Neptune.io agent.
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Process running on this machine.
+type processInfo struct {
+	Pid     int    `json:"pid"`
+	Command string `json:"command"`
+}
+
+// Function to get the name of the executable of the process, without its directory and arguments.
+func (p processInfo) name() string {
+	fields := strings.Fields(p.Command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
+// Function to list the processes running on this machine with their command lines. On linux the process
+// table is read from /proc and on other platforms from the output of the standard tools.
+func listProcesses() ([]processInfo, error) {
+	switch runtime.GOOS {
+	case "linux":
+		entries, err := ioutil.ReadDir("/proc")
+		if err != nil {
+			return nil, err
+		}
+		processes := []processInfo{}
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			// Processes might exit while we are reading them.
+			cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+			if err != nil {
+				continue
+			}
+			if len(cmdline) == 0 {
+				// Kernel threads have no command line, only a name.
+				comm, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+				if err != nil {
+					continue
+				}
+				cmdline = bytes.TrimSpace(comm)
+			}
+			command := strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+			processes = append(processes, processInfo{Pid: pid, Command: command})
+		}
+		return processes, nil
+	case "windows":
+		out, err := exec.Command("tasklist", "/FO", "CSV", "/NH").Output()
+		if err != nil {
+			return nil, err
+		}
+		processes := []processInfo{}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Split(strings.TrimSpace(line), ",")
+			if len(fields) < 2 || len(fields[0]) == 0 {
+				continue
+			}
+			pid, err := strconv.Atoi(strings.Trim(fields[1], "\""))
+			if err != nil {
+				continue
+			}
+			processes = append(processes, processInfo{Pid: pid, Command: strings.Trim(fields[0], "\"")})
+		}
+		return processes, nil
+	default:
+		out, err := exec.Command("ps", "-axo", "pid=,command=").Output()
+		if err != nil {
+			return nil, err
+		}
+		processes := []processInfo{}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if len(fields) < 2 {
+				continue
+			}
+			pid, err := strconv.Atoi(fields[0])
+			if err != nil {
+				continue
+			}
+			processes = append(processes, processInfo{Pid: pid, Command: strings.TrimSpace(fields[1])})
+		}
+		return processes, nil
+	}
+}
+
+// Function to check if a process whose command line contains the given name is running.
+func isProcessRunning(name string) (bool, error) {
+	processes, err := listProcesses()
+	if err != nil {
+		return false, err
+	}
+	for _, p := range processes {
+		if strings.Contains(p.Command, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
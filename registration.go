@@ -33,6 +33,7 @@ type RegistrationRequest struct {
 	PublicDnsName      string
 	Region             string
 	StartTime          int64
+	Plugins            []PluginInfo
 }
 
 // Message received from Neptune.io service when agent's registration has succeeded.
@@ -63,11 +64,14 @@ func getAgentRegistrationRequest(data HostMetaData) RegistrationRequest {
 		PublicDnsName:      data.PublicDnsName,
 		Region:             data.Region,
 		StartTime:          startTime,
+		Plugins:            listPlugins(),
 	}
 }
 
 // Function to register this agent with Neptune.io service.
-func RegisterAgent(data HostMetaData, configObj *NeptuneConfig) (*RegistrationInfo, error) {
+func RegisterAgent(data HostMetaData, configObj *NeptuneConfig) (info *RegistrationInfo, err error) {
+	defer func() { registrations.inc(outcome(err)) }()
+
 	request := getAgentRegistrationRequest(data)
 	response := RegistrationInfo{}
 	logging.Info("Registering the agent.", logging.Fields{"request": request})
@@ -79,6 +83,7 @@ func RegisterAgent(data HostMetaData, configObj *NeptuneConfig) (*RegistrationIn
 	}
 
 	if 200 <= resp.Status() && resp.Status() <= 299 {
+		logging.AddRotatingSensitiveValues(response.AWSSecretAccessKey, response.AWSSecurityToken)
 		logging.Info("Successfully registered the agent.", logging.Fields{"agentId": response.AgentId})
 		return &response, nil
 	} else {
@@ -0,0 +1,153 @@
+// Package results is responsible for reading the structured results which runbooks can write
+// in addition to their plain text output. The agent exposes the path of the result file to the
+// runbook through an environment variable and validates the file after the runbook finishes.
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Environment variable holding the path at which the runbook can write its structured result.
+	resultFileEnvVar = "NEPTUNE_RESULT_FILE"
+	resultFileSuffix = ".result.json"
+
+	// Limits on the structured result so that a runbook can't flood Neptune.io.
+	maxResultFileSize      = 256 * 1024
+	maxResultSummaryLength = 1024
+	maxResultEntries       = 100
+	maxResultValueLength   = 4096
+	maxResultLinks         = 20
+)
+
+// Structured result written by a runbook, which Neptune.io rules can branch on.
+type ActionResult struct {
+	Summary string             `json:"summary,omitempty"`
+	Facts   map[string]string  `json:"facts,omitempty"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	Links   []ResultLink       `json:"links,omitempty"`
+}
+
+// Link to an external page related to the runbook execution, like a dashboard or a ticket.
+type ResultLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// Function to get the path of the result file for the given event.
+func resultFilePath(eventId string) string {
+	return filepath.Join(workingDir, eventId+resultFileSuffix)
+}
+
+// Function to read and validate the result file written by the runbook. Returns nil result and nil
+// error if the runbook didn't write any result.
+func readActionResult(path string) (*ActionResult, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	if info.Size() > maxResultFileSize {
+		return nil, fmt.Errorf("Result file is larger than %d bytes.", maxResultFileSize)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ActionResult
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("Result file is not valid JSON: %v", err)
+	}
+
+	if err := result.validate(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Function to validate the structured result against the limits.
+func (r *ActionResult) validate() error {
+	if len(r.Summary) > maxResultSummaryLength {
+		return fmt.Errorf("Result summary is longer than %d characters.", maxResultSummaryLength)
+	}
+	if strings.ContainsAny(r.Summary, "\r\n") {
+		return errors.New("Result summary must be a single line.")
+	}
+
+	if len(r.Facts) > maxResultEntries {
+		return fmt.Errorf("Result has more than %d facts.", maxResultEntries)
+	}
+	for k, v := range r.Facts {
+		if len(k) == 0 {
+			return errors.New("Result fact names must not be empty.")
+		}
+		if len(v) > maxResultValueLength {
+			return fmt.Errorf("Result fact %q is longer than %d characters.", k, maxResultValueLength)
+		}
+	}
+
+	if len(r.Metrics) > maxResultEntries {
+		return fmt.Errorf("Result has more than %d metrics.", maxResultEntries)
+	}
+	for k := range r.Metrics {
+		if len(k) == 0 {
+			return errors.New("Result metric names must not be empty.")
+		}
+	}
+
+	if len(r.Links) > maxResultLinks {
+		return fmt.Errorf("Result has more than %d links.", maxResultLinks)
+	}
+	for _, link := range r.Links {
+		u, err := url.Parse(link.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("Result link %q is not an absolute http(s) URL.", link.URL)
+		}
+	}
+
+	return nil
+}
+
+// Function to mask the secrets in the structured result.
+func (r *ActionResult) redact() {
+	r.Summary = logging.Redact(r.Summary)
+	for k, v := range r.Facts {
+		r.Facts[k] = logging.Redact(v)
+	}
+	for i := range r.Links {
+		r.Links[i].URL = logging.Redact(r.Links[i].URL)
+	}
+}
+
+// Function to collect the result written by the runbook and attach it to the action output.
+// Invalid results are reported back in the result error instead of failing the execution.
+func attachActionResult(output *ActionOutputMessage, path string) {
+	defer os.Remove(path)
+
+	result, err := readActionResult(path)
+	if err != nil {
+		logging.Warn("Runbook wrote an invalid result.", logging.Fields{"eventId": output.EventId, "error": err})
+		output.ResultError = err.Error()
+		return
+	}
+	output.Result = result
+}
@@ -0,0 +1,135 @@
+// Package retry is responsible for retrying failed runbook executions as per the retry policy of the
+// runbook. Every attempt is reported to Neptune.io with its attempt number under the same inflight
+// action id. Retries of a rule are limited by an hourly budget so that a broken runbook can't keep
+// the host busy.
+package agent
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Environment variable telling the runbook which attempt it is, starting at 1.
+	attemptEnvVar = "NEPTUNE_ATTEMPT"
+
+	// Kind of the history records of attempts which were retried.
+	attemptHistoryKind = "attempt"
+
+	retryBudgetWindow = time.Hour
+)
+
+// Policy to retry a failed runbook or step. Without exit codes and timeout, any failure is retried.
+// Otherwise only the listed exit codes, and timeouts if enabled, are retried. The delay before the
+// n-th retry is DelaySeconds * BackoffMultiplier^(n-1), up to MaxDelaySeconds if set.
+type RetryPolicy struct {
+	MaxAttempts       int     `json:"maxAttempts"`
+	DelaySeconds      int     `json:"delaySeconds"`
+	BackoffMultiplier float64 `json:"backoffMultiplier"`
+	MaxDelaySeconds   int     `json:"maxDelaySeconds"`
+	RetryOnExitCodes  []int   `json:"retryOnExitCodes"`
+	RetryOnTimeout    bool    `json:"retryOnTimeout"`
+}
+
+// Global variable to hold the retry settings.
+var retryConfig RetryConfig
+
+// Global variable to hold the times of the recent retries of each rule.
+var retryBudget = struct {
+	sync.Mutex
+	retries map[string][]time.Time
+}{retries: map[string][]time.Time{}}
+
+// Function to initialize the retry settings from agent config.
+func InitializeRetries(config RetryConfig) {
+	retryConfig = config
+	logging.Info("Initialized runbook retries.", logging.Fields{"runbooks": len(config.Runbooks),
+		"budgetPerRulePerHour": config.BudgetPerRulePerHour})
+}
+
+// Function to get the retry policy for the given event. The policy sent with the event takes precedence
+// over the one configured for the runbook, which in turn takes precedence over the default one.
+// Returns nil if the runbook isn't to be retried.
+func retryPolicyFor(event *Event) *RetryPolicy {
+	if event.Retry != nil {
+		return event.Retry
+	}
+	for _, name := range []string{event.RunbookName, event.GithubFilePath} {
+		if policy, ok := retryConfig.Runbooks[name]; ok && len(name) > 0 {
+			return &policy
+		}
+	}
+	return retryConfig.Default
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Function to check if the given failed result is to be retried.
+func (p *RetryPolicy) shouldRetry(result commandResult) bool {
+	if p == nil || result.Status == "SUCCESS" {
+		return false
+	}
+	if len(p.RetryOnExitCodes) == 0 && !p.RetryOnTimeout {
+		return true
+	}
+	if result.Timeout {
+		return p.RetryOnTimeout
+	}
+	for _, code := range p.RetryOnExitCodes {
+		if code == result.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the delay before retrying the given failed attempt.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	if p == nil || p.DelaySeconds <= 0 {
+		return 0
+	}
+
+	seconds := float64(p.DelaySeconds)
+	if p.BackoffMultiplier > 1 {
+		seconds *= math.Pow(p.BackoffMultiplier, float64(attempt-1))
+	}
+	if p.MaxDelaySeconds > 0 && seconds > float64(p.MaxDelaySeconds) {
+		seconds = float64(p.MaxDelaySeconds)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Function to take a retry from the hourly budget of the given rule. Returns false if the budget is
+// used up, in which case the failure is final.
+func takeRetryBudget(ruleId string) bool {
+	if retryConfig.BudgetPerRulePerHour <= 0 {
+		return true
+	}
+
+	retryBudget.Lock()
+	defer retryBudget.Unlock()
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range retryBudget.retries[ruleId] {
+		if now.Sub(t) < retryBudgetWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= retryConfig.BudgetPerRulePerHour {
+		retryBudget.retries[ruleId] = recent
+		logging.Warn("Retry budget of the rule is used up.", logging.Fields{"ruleId": ruleId, "budget": retryConfig.BudgetPerRulePerHour})
+		return false
+	}
+	retryBudget.retries[ruleId] = append(recent, now)
+	return true
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// Test which failures are retried as per the exit codes and timeout of the policy.
+func TestShouldRetry(t *testing.T) {
+	failed := commandResult{Status: "FAILED", StatusCode: 2}
+	timedOut := commandResult{Status: "FAILED", StatusCode: -1, Timeout: true}
+
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		result commandResult
+		want   bool
+	}{
+		{name: "no policy", policy: nil, result: failed, want: false},
+		{name: "success", policy: &RetryPolicy{}, result: commandResult{Status: "SUCCESS"}, want: false},
+		{name: "any failure", policy: &RetryPolicy{}, result: failed, want: true},
+		{name: "any timeout", policy: &RetryPolicy{}, result: timedOut, want: true},
+		{name: "listed exit code", policy: &RetryPolicy{RetryOnExitCodes: []int{1, 2}}, result: failed, want: true},
+		{name: "other exit code", policy: &RetryPolicy{RetryOnExitCodes: []int{1}}, result: failed, want: false},
+		{name: "timeout not enabled", policy: &RetryPolicy{RetryOnExitCodes: []int{-1}}, result: timedOut, want: false},
+		{name: "timeout enabled", policy: &RetryPolicy{RetryOnTimeout: true}, result: timedOut, want: true},
+		{name: "exit code with only timeout enabled", policy: &RetryPolicy{RetryOnTimeout: true}, result: failed, want: false},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.shouldRetry(test.result); got != test.want {
+			t.Errorf("%s: shouldRetry() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Test that a runbook runs at least once and at most the attempts of its policy.
+func TestMaxAttempts(t *testing.T) {
+	tests := []struct {
+		policy *RetryPolicy
+		want   int
+	}{
+		{policy: nil, want: 1},
+		{policy: &RetryPolicy{}, want: 1},
+		{policy: &RetryPolicy{MaxAttempts: -2}, want: 1},
+		{policy: &RetryPolicy{MaxAttempts: 3}, want: 3},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.maxAttempts(); got != test.want {
+			t.Errorf("maxAttempts() of %+v = %d, want %d", test.policy, got, test.want)
+		}
+	}
+}
+
+// Test the exponential backoff between the attempts and its cap.
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{name: "no policy", policy: nil, attempt: 1, want: 0},
+		{name: "no delay", policy: &RetryPolicy{BackoffMultiplier: 2}, attempt: 3, want: 0},
+		{name: "fixed", policy: &RetryPolicy{DelaySeconds: 5}, attempt: 3, want: 5 * time.Second},
+		{name: "first backoff", policy: &RetryPolicy{DelaySeconds: 5, BackoffMultiplier: 2}, attempt: 1, want: 5 * time.Second},
+		{name: "third backoff", policy: &RetryPolicy{DelaySeconds: 5, BackoffMultiplier: 2}, attempt: 3, want: 20 * time.Second},
+		{name: "fractional backoff", policy: &RetryPolicy{DelaySeconds: 2, BackoffMultiplier: 1.5}, attempt: 2, want: 3 * time.Second},
+		{name: "shrinking multiplier", policy: &RetryPolicy{DelaySeconds: 5, BackoffMultiplier: 0.5}, attempt: 3, want: 5 * time.Second},
+		{name: "capped", policy: &RetryPolicy{DelaySeconds: 5, BackoffMultiplier: 2, MaxDelaySeconds: 30}, attempt: 5, want: 30 * time.Second},
+		{name: "under the cap", policy: &RetryPolicy{DelaySeconds: 5, BackoffMultiplier: 2, MaxDelaySeconds: 30}, attempt: 2, want: 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.delay(test.attempt); got != test.want {
+			t.Errorf("%s: delay(%d) = %v, want %v", test.name, test.attempt, got, test.want)
+		}
+	}
+}
+
+// Test that the policy of the event takes precedence over the one of the runbook and the default one.
+func TestRetryPolicyFor(t *testing.T) {
+	oldConfig := retryConfig
+	defer func() { retryConfig = oldConfig }()
+
+	eventPolicy := &RetryPolicy{MaxAttempts: 2}
+	defaultPolicy := &RetryPolicy{MaxAttempts: 4}
+	retryConfig = RetryConfig{Default: defaultPolicy, Runbooks: map[string]RetryPolicy{
+		"restart":           {MaxAttempts: 3},
+		"runbooks/clean.sh": {MaxAttempts: 5},
+	}}
+
+	tests := []struct {
+		name  string
+		event *Event
+		want  int
+	}{
+		{name: "event", event: &Event{RunbookName: "restart", Retry: eventPolicy}, want: 2},
+		{name: "runbook name", event: &Event{RunbookName: "restart"}, want: 3},
+		{name: "Github file path", event: &Event{GithubFilePath: "runbooks/clean.sh"}, want: 5},
+		{name: "default", event: &Event{RunbookName: "other"}, want: 4},
+	}
+
+	for _, test := range tests {
+		if got := retryPolicyFor(test.event).maxAttempts(); got != test.want {
+			t.Errorf("%s: retryPolicyFor() has %d attempts, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Test that the retries of a rule are limited by its hourly budget.
+func TestTakeRetryBudget(t *testing.T) {
+	oldConfig, oldRetries := retryConfig, retryBudget.retries
+	defer func() { retryConfig, retryBudget.retries = oldConfig, oldRetries }()
+	retryConfig = RetryConfig{BudgetPerRulePerHour: 2}
+	retryBudget.retries = map[string][]time.Time{"old": {time.Now().Add(-2 * time.Hour), time.Now().Add(-90 * time.Minute)}}
+
+	for i, want := range []bool{true, true, false} {
+		if got := takeRetryBudget("rule"); got != want {
+			t.Errorf("takeRetryBudget() #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !takeRetryBudget("other") {
+		t.Errorf("takeRetryBudget() of another rule failed")
+	}
+	if !takeRetryBudget("old") {
+		t.Errorf("takeRetryBudget() failed with retries past the window only")
+	}
+}
@@ -0,0 +1,148 @@
+// Package rollback is responsible for running the rollback runbook of a remediation which failed.
+// An event or a runbook manifest can name a rollback runbook. It runs once the main runbook has
+// failed for good, after all its retries, and gets the environment of the main runbook along with
+// the details of the failure.
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	rollbackStepName = "rollback"
+
+	// Kind of the history records of rollbacks.
+	rollbackHistoryKind = "rollback"
+
+	// Environment variables describing the failure to the rollback runbook.
+	failureStatusEnvVar     = "NEPTUNE_FAILURE_STATUS"
+	failureExitCodeEnvVar   = "NEPTUNE_FAILURE_EXIT_CODE"
+	failureTimeoutEnvVar    = "NEPTUNE_FAILURE_TIMEOUT"
+	failureStepEnvVar       = "NEPTUNE_FAILURE_STEP"
+	failureOutputFileEnvVar = "NEPTUNE_FAILURE_OUTPUT_FILE"
+
+	failureOutputFileSuffix = ".failure.log"
+)
+
+// Reference to a runbook, either inline or a Github file path. Timeout defaults to the one of the event.
+type RunbookRef struct {
+	RunbookName    string `json:"runbookName"`
+	RawCommand     string `json:"rawCommand"`
+	GithubFilePath string `json:"githubFilePath"`
+	Timeout        int32  `json:"timeout"`
+}
+
+func (r *RunbookRef) validate() error {
+	if (len(r.RawCommand) > 0) == (len(r.GithubFilePath) > 0) {
+		return errors.New("Runbook reference must have exactly one of rawCommand and githubFilePath.")
+	}
+	if r.Timeout < 0 {
+		return errors.New("Runbook reference has a negative timeout.")
+	}
+	return nil
+}
+
+// Function to get the rollback runbook for the given event. The one named by the event takes precedence
+// over the one in the manifest. Returns nil if there is none.
+func rollbackFor(event *Event, manifest *RunbookManifest) *RunbookRef {
+	if event.Rollback != nil {
+		return event.Rollback
+	}
+	if manifest != nil {
+		return manifest.Rollback
+	}
+	return nil
+}
+
+// Function to fetch the script of the referenced runbook. An inline script sent with the event is only
+// accepted if the agent isn't restricted to Github runbooks.
+func loadRunbookRef(ref *RunbookRef, githubKey string, fromEvent bool) (string, error) {
+	if err := ref.validate(); err != nil {
+		return "", err
+	}
+	if len(ref.GithubFilePath) > 0 {
+		if githubKey == "" {
+			return "", errors.New("Empty Github api key.")
+		}
+		return getRunbookFromGithub(githubKey, ref.GithubFilePath)
+	}
+	if fromEvent && len(githubKey) > 0 {
+		return "", errors.New("Agent is configured to run Github runbooks only but the rollback is a Neptune runbook.")
+	}
+	return ref.RawCommand, nil
+}
+
+// Function to run the rollback runbook after the main runbook of the event failed with the given result.
+func runRollback(event *Event, ref *RunbookRef, githubKey string, extraEnv map[string]string, failed commandResult) *StepResult {
+	logging.Info("Running the rollback runbook.", logging.Fields{"eventId": event.EventId, "runbook": ref.RunbookName})
+
+	start := time.Now()
+	result := commandResult{Status: stepFailed, StatusCode: 1}
+	script, err := loadRunbookRef(ref, githubKey, event.Rollback == ref)
+	if err != nil {
+		logging.Error("Could not get the rollback runbook.", logging.Fields{"eventId": event.EventId, "error": err})
+		result.Stderr = "Could not get the rollback runbook: " + err.Error()
+	} else if tmpFile, err := writeToTmpFile(event.EventId+"-"+rollbackStepName, ref.RunbookName+ref.GithubFilePath, &script); err != nil {
+		result.Stderr = "Could not write the rollback runbook to a file."
+	} else {
+		defer os.Remove(tmpFile)
+
+		env := failureEnv(event, failed)
+		defer os.Remove(env[failureOutputFileEnvVar])
+		for k, v := range extraEnv {
+			env[k] = v
+		}
+
+		timeout := ref.Timeout
+		if timeout <= 0 {
+			timeout = event.Timeout
+		}
+
+		cmd := scriptCommand(tmpFile, strings.HasPrefix(script, shebangPrefix))
+		cmd.Env = commandEnv(event, env)
+		result = runCommand(cmd, time.Second*time.Duration(timeout), nil, "", func(pid int) func() {
+			if pid > 0 {
+				return recordSpawned(event, pid)
+			}
+			return nil
+		})
+	}
+	recordResult(rollbackHistoryKind, event, start, result)
+
+	rollback := newStepResult(rollbackStepName, result, start, time.Now())
+	rollback.setOutput(result.Stdout, result.Stderr, maxOutputSize(), maxOutputSize())
+	logging.Info("Finished the rollback runbook.", logging.Fields{"eventId": event.EventId, "status": rollback.Status})
+	return &rollback
+}
+
+// Function to get the environment variables describing the failure. The output of the failed runbook is
+// written to a file since it can be large.
+func failureEnv(event *Event, failed commandResult) map[string]string {
+	env := map[string]string{
+		failureStatusEnvVar:   failed.Status,
+		failureExitCodeEnvVar: fmt.Sprint(failed.StatusCode),
+		failureTimeoutEnvVar:  fmt.Sprint(failed.Timeout),
+	}
+	for _, step := range failed.Steps {
+		if step.Status == stepFailed || step.Status == stepTimeout {
+			env[failureStepEnvVar] = step.Name
+			break
+		}
+	}
+
+	path := filepath.Join(workingDir, event.EventId+failureOutputFileSuffix)
+	if err := ioutil.WriteFile(path, []byte(failed.Stdout+failed.Stderr), 0600); err != nil {
+		logging.Warn("Could not write the failure output file.", logging.Fields{"error": err, "file": path})
+	} else {
+		env[failureOutputFileEnvVar] = path
+	}
+	return env
+}
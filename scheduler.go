@@ -0,0 +1,203 @@
+// Package scheduler is responsible for the runbooks scheduled locally on the agent. Jobs come from the
+// agent config or from job files in a directory, and run on cron schedules with an optional jitter.
+// Each run is a synthetic event which goes through the same ExecuteAction pipeline as the events from
+// Neptune.io, and is reported under a rule identity derived from the job name.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Source of the synthetic events created by the agent itself.
+	localEventSource = "agent"
+
+	// Prefix of the rule ids of scheduled jobs, which don't exist in Neptune.io.
+	scheduledRulePrefix = "schedule:"
+
+	jobFileExtension         = ".json"
+	defaultLocalEventTimeout = 300
+
+	skippedHistoryKind = "skipped"
+	skippedStatus      = "SKIPPED"
+)
+
+// Runbook scheduled locally. The runbook is either inline or a Github file path. If SkipIfRunning is
+// set, a run is skipped while the previous run of the job is still going on.
+type ScheduledJob struct {
+	Name           string            `json:"name"`
+	Cron           string            `json:"cron"`
+	JitterSeconds  int               `json:"jitterSeconds"`
+	SkipIfRunning  bool              `json:"skipIfRunning"`
+	RunbookName    string            `json:"runbookName"`
+	RawCommand     string            `json:"rawCommand"`
+	GithubFilePath string            `json:"githubFilePath"`
+	Timeout        int32             `json:"timeout"`
+	Environment    map[string]string `json:"env"`
+}
+
+// Global variable to hold the jobs which are running right now.
+var runningJobs = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// Global counter of the local events created, which keeps their ids unique.
+var localEventCount uint64
+
+// Function to start the scheduled jobs from the agent config and the job files. Invalid jobs are skipped,
+// and so are the jobs whose name is already taken since the name identifies the rule of a job. Jobs from
+// the agent config come first.
+func StartScheduler(config SchedulerConfig, dir string, regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, githubKey string) {
+	jobs := append([]ScheduledJob{}, config.Jobs...)
+	if len(config.JobsDir) > 0 {
+		jobs = append(jobs, loadJobFiles(absPath(dir, config.JobsDir))...)
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	numStarted := 0
+	names := map[string]bool{}
+	for _, job := range jobs {
+		schedule, err := parseCron(job.Cron)
+		if err != nil || len(job.Name) == 0 || (len(job.RawCommand) > 0) == (len(job.GithubFilePath) > 0) {
+			logging.Warn("Ignoring invalid scheduled job.", logging.Fields{"job": job.Name, "cron": job.Cron, "error": err})
+			continue
+		}
+		if names[job.Name] {
+			logging.Warn("Ignoring scheduled job with duplicate name.", logging.Fields{"job": job.Name, "cron": job.Cron})
+			continue
+		}
+		names[job.Name] = true
+		go runScheduledJob(job, schedule, regInfo, actionOutputs, githubKey)
+		numStarted++
+	}
+	logging.Info("Started the scheduled jobs.", logging.Fields{"count": numStarted})
+}
+
+// Function to load the jobs from the job files in the given directory, one job per file. The name of a
+// job defaults to the name of its file.
+func loadJobFiles(dir string) []ScheduledJob {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+jobFileExtension))
+	if err != nil {
+		logging.Warn("Could not list the job files.", logging.Fields{"error": err, "dir": dir})
+		return nil
+	}
+
+	jobs := []ScheduledJob{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logging.Warn("Could not read the job file.", logging.Fields{"error": err, "file": path})
+			continue
+		}
+
+		var job ScheduledJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			logging.Warn("Could not parse the job file.", logging.Fields{"error": err, "file": path})
+			continue
+		}
+		if len(job.Name) == 0 {
+			job.Name = strings.TrimSuffix(filepath.Base(path), jobFileExtension)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func runScheduledJob(job ScheduledJob, schedule *cronSchedule, regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, githubKey string) {
+	// Each job has its own source of jitter since a rand.Rand can't be shared between goroutines.
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			logging.Warn("Scheduled job never runs again.", logging.Fields{"job": job.Name})
+			return
+		}
+		if job.JitterSeconds > 0 {
+			next = next.Add(time.Duration(random.Int63n(int64(job.JitterSeconds) * int64(time.Second))))
+		}
+		time.Sleep(next.Sub(time.Now()))
+
+		if !startJob(job) {
+			logging.Info("Skipping the scheduled job since its previous run is still going on.", logging.Fields{"job": job.Name})
+			now := time.Now().UnixNano() / 1000000
+			recordHistory(HistoryRecord{Kind: skippedHistoryKind, RuleId: scheduledRulePrefix + job.Name, RuleName: job.Name,
+				StartTime: now, EndTime: now, Status: skippedStatus})
+			continue
+		}
+
+		go func() {
+			defer finishJob(job)
+			runbook := RunbookRef{RunbookName: job.RunbookName, RawCommand: job.RawCommand, GithubFilePath: job.GithubFilePath, Timeout: job.Timeout}
+			event := localEvent(scheduledRulePrefix, job.Name, runbook, job.Environment)
+			if err := ExecuteAction(event, regInfo, actionOutputs, githubKey); err != nil {
+				logging.Error("Could not run the scheduled job.", logging.Fields{"job": job.Name, "error": err})
+			}
+		}()
+	}
+}
+
+// Function to mark the job as running. Returns false if the job must be skipped since it's already running.
+func startJob(job ScheduledJob) bool {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+
+	if job.SkipIfRunning && runningJobs.names[job.Name] {
+		return false
+	}
+	runningJobs.names[job.Name] = true
+	return true
+}
+
+func finishJob(job ScheduledJob) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	delete(runningJobs.names, job.Name)
+}
+
+// Function to create a synthetic event for a local run of the given runbook. The rule id is made of the
+// given prefix and name. The event id is unique even for runs started at the same time.
+func localEvent(rulePrefix, name string, runbook RunbookRef, env map[string]string) *Event {
+	now := time.Now()
+	eventId := fmt.Sprintf("%s-%s-%d-%d", strings.TrimSuffix(rulePrefix, ":"), safeFileName(name), now.UnixNano(),
+		atomic.AddUint64(&localEventCount, 1))
+
+	timeout := runbook.Timeout
+	if timeout <= 0 {
+		timeout = defaultLocalEventTimeout
+	}
+
+	event := &Event{
+		Timestamp:        now.UnixNano() / 1000000,
+		Source:           localEventSource,
+		EventId:          eventId,
+		RuleId:           rulePrefix + name,
+		RuleName:         name,
+		InflightActionId: eventId,
+		RunbookName:      runbook.RunbookName,
+		RawCommand:       runbook.RawCommand,
+		GithubFilePath:   runbook.GithubFilePath,
+		Timeout:          timeout,
+		Environment:      env,
+		local:            true,
+	}
+	if md != nil {
+		event.Hostname = md.HostName
+	}
+	if regInfo != nil {
+		event.AgentId = regInfo.AgentId
+	}
+	return event
+}
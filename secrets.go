@@ -0,0 +1,379 @@
+// Package secrets is responsible for resolving the secrets referenced by runbooks from the
+// providers configured locally on the agent machine. Secret values never travel through SQS or
+// Neptune.io; events only carry secret names and the values are injected into the runbook
+// process environment at execution time.
+package agent
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// Separator between an optional provider name and the secret name in a secret reference.
+	// For example, "vault:db/creds#password" or just "db_password".
+	secretProviderSep = ":"
+
+	// Separator between the secret path and the field name in a Vault secret name.
+	vaultFieldSep       = "#"
+	defaultVaultField   = "value"
+	defaultVaultMount   = "secret"
+	vaultRequestTimeout = 10 * time.Second
+
+	fileVaultProviderName = "file"
+	envFileProviderName   = "env"
+	vaultProviderName     = "vault"
+)
+
+// SecretProvider is implemented by all the local secret stores that agent can read secrets from.
+type SecretProvider interface {
+	// Name of the provider which can be used to pin a secret reference to this provider.
+	Name() string
+
+	// Looks up the secret with given name. The bool is false if the provider doesn't have the secret.
+	Lookup(name string) (string, bool, error)
+}
+
+// Global variable to hold the configured secret providers in the order of their precedence.
+var secretProviders []SecretProvider
+
+// Function to initialize the secret providers based on agent config. Relative paths in the config
+// are resolved against the given directory.
+func InitializeSecretProviders(config SecretsConfig, dir string) {
+	providers := []SecretProvider{}
+
+	if len(config.FileVault.Path) > 0 {
+		providers = append(providers, &fileVaultProvider{
+			path:    absPath(dir, config.FileVault.Path),
+			keyFile: absPath(dir, config.FileVault.KeyFile),
+		})
+	}
+
+	if len(config.EnvFiles) > 0 {
+		paths := []string{}
+		for _, p := range config.EnvFiles {
+			paths = append(paths, absPath(dir, p))
+		}
+		providers = append(providers, &envFileProvider{paths: paths})
+	}
+
+	if len(config.Vault.Address) > 0 {
+		mount := config.Vault.Mount
+		if len(mount) == 0 {
+			mount = defaultVaultMount
+		}
+		providers = append(providers, &vaultProvider{
+			address:   strings.TrimRight(config.Vault.Address, slash),
+			token:     config.Vault.Token,
+			tokenFile: absPath(dir, config.Vault.TokenFile),
+			mount:     strings.Trim(mount, slash),
+		})
+	}
+
+	names := []string{}
+	for _, p := range providers {
+		names = append(names, p.Name())
+	}
+	logging.Info("Initialized secret providers.", logging.Fields{"providers": names})
+
+	secretProviders = providers
+}
+
+// Helper function to resolve a possibly relative path against the given directory.
+func absPath(dir, path string) string {
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Function to resolve the secret references of an event. The given map is from environment variable
+// name to secret reference and the returned map is from environment variable name to secret value.
+// Secret values must never be logged.
+func resolveSecrets(refs map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(refs))
+	for envName, ref := range refs {
+		value, err := lookupSecret(ref)
+		if err != nil {
+			logging.Error("Could not resolve the secret.", logging.Fields{"secret": ref, "env": envName, "error": err})
+			return nil, fmt.Errorf("Could not resolve the secret %q referenced by %s. %v", ref, envName, err)
+		}
+		values[envName] = value
+		logging.AddRotatingSensitiveValues(value)
+	}
+	return values, nil
+}
+
+// Function to look up a single secret reference across the configured providers.
+func lookupSecret(ref string) (string, error) {
+	providerName, name := "", ref
+	if parts := strings.SplitN(ref, secretProviderSep, 2); len(parts) == 2 && isSecretProvider(parts[0]) {
+		providerName, name = parts[0], parts[1]
+	}
+
+	var lastErr error
+	for _, p := range secretProviders {
+		if len(providerName) > 0 && p.Name() != providerName {
+			continue
+		}
+
+		value, found, err := p.Lookup(name)
+		if err != nil {
+			logging.Warn("Secret provider failed to look up the secret.", logging.Fields{"provider": p.Name(), "secret": name, "error": err})
+			lastErr = err
+			continue
+		}
+		if found {
+			return value, nil
+		}
+	}
+
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", fmt.Errorf("Secret %q is not found in any of the secret providers.", ref)
+}
+
+func isSecretProvider(name string) bool {
+	return name == fileVaultProviderName || name == envFileProviderName || name == vaultProviderName
+}
+
+// Provider reading secrets from a file encrypted with AES-256-GCM. The file holds the base64 encoding
+// of a 12 byte nonce followed by the ciphertext of a JSON object of secret names to values. The key
+// file holds the 32 byte key, hex encoded.
+type fileVaultProvider struct {
+	path    string
+	keyFile string
+}
+
+func (p *fileVaultProvider) Name() string {
+	return fileVaultProviderName
+}
+
+func (p *fileVaultProvider) Lookup(name string) (string, bool, error) {
+	secrets, err := p.load()
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := secrets[name]
+	return value, ok, nil
+}
+
+// Reads and decrypts the vault file. The file is read on every lookup so that rotated secrets are
+// picked up without restarting the agent.
+func (p *fileVaultProvider) load() (map[string]string, error) {
+	keyData, err := ioutil.ReadFile(p.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyData)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("Vault key must be 32 bytes, hex encoded.")
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.New("Vault file is not base64 encoded.")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Vault file is too short.")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("Could not decrypt the vault file.")
+	}
+
+	secrets := map[string]string{}
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, errors.New("Vault file does not contain a JSON object of secrets.")
+	}
+	return secrets, nil
+}
+
+// Provider reading secrets from env files with KEY=VALUE lines. Files readable by anyone other than
+// the owner are rejected.
+type envFileProvider struct {
+	paths []string
+}
+
+func (p *envFileProvider) Name() string {
+	return envFileProviderName
+}
+
+// Function to look up the secret in the env files, in order. Files which can't be read are skipped, and
+// the error of the last of them is returned if no other file has the secret.
+func (p *envFileProvider) Lookup(name string) (string, bool, error) {
+	var lastErr error
+	for _, path := range p.paths {
+		secrets, err := readEnvFile(path)
+		if err != nil {
+			logging.Warn("Could not read the env file.", logging.Fields{"file": path, "error": err})
+			lastErr = err
+			continue
+		}
+
+		if value, ok := secrets[name]; ok {
+			return value, true, nil
+		}
+	}
+	return "", false, lastErr
+}
+
+func readEnvFile(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// File permissions are not meaningful on windows.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Env file %s must have 0600 permissions but has %#o.", path, info.Mode().Perm())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		secrets[strings.TrimSpace(parts[0])] = value
+	}
+
+	return secrets, scanner.Err()
+}
+
+// Provider reading secrets from a HashiCorp Vault compatible KV version 2 HTTP API. Secret names have
+// the form "path#field" and the field defaults to "value".
+type vaultProvider struct {
+	address   string
+	token     string
+	tokenFile string
+	mount     string
+}
+
+// Response of Vault KV version 2 read secret API.
+type vaultSecretResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+func (p *vaultProvider) Name() string {
+	return vaultProviderName
+}
+
+func (p *vaultProvider) Lookup(name string) (string, bool, error) {
+	path, field := name, defaultVaultField
+	if i := strings.LastIndex(name, vaultFieldSep); i >= 0 {
+		path, field = name[:i], name[i+1:]
+	}
+
+	token, err := p.getToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	req, err := http.NewRequest("GET", strings.Join([]string{p.address, "v1", p.mount, "data", strings.Trim(path, slash)}, slash), nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := http.Client{Timeout: vaultRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", false, fmt.Errorf("Vault returned unexpected status: %d", resp.StatusCode)
+	}
+
+	var secret vaultSecretResponse
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", false, err
+	}
+
+	value, ok := secret.Data.Data[field]
+	if !ok {
+		return "", false, nil
+	}
+	if s, ok := value.(string); ok {
+		return s, true, nil
+	}
+	return fmt.Sprintf("%v", value), true, nil
+}
+
+func (p *vaultProvider) getToken() (string, error) {
+	if len(p.token) > 0 {
+		return p.token, nil
+	}
+
+	if len(p.tokenFile) > 0 {
+		data, err := ioutil.ReadFile(p.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if token := os.Getenv("VAULT_TOKEN"); len(token) > 0 {
+		return token, nil
+	}
+	return "", errors.New("Vault token is not configured.")
+}
@@ -4,8 +4,10 @@ package agent
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/neptuneio/agent/logging"
@@ -27,14 +29,60 @@ const (
 )
 
 var queueURLRegex = regexp.MustCompile(`https://sqs\.(.*)\.amazonaws.com(.*)`)
-var requiredAttributes []*string
+
+// Message attributes fetched with every SQS message.
+var messageAttributeNames []*string
+
+// Counters of the SQS polling since the agent started. Times are in milliseconds since epoch.
+type QueueStats struct {
+	Polls               int64 `json:"polls"`
+	PollFailures        int64 `json:"pollFailures"`
+	ConsecutiveFailures int   `json:"consecutiveFailures"`
+	MessagesReceived    int64 `json:"messagesReceived"`
+	MessagesAccepted    int64 `json:"messagesAccepted"`
+	MessagesReleased    int64 `json:"messagesReleased"`
+	MessagesRejected    int64 `json:"messagesRejected"`
+	LastPollTime        int64 `json:"lastPollTime"`
+	LastSuccessTime     int64 `json:"lastSuccessTime"`
+}
+
+// Global variables to hold the SQS polling counters.
+var queueStats QueueStats
+var queueStatsLock sync.Mutex
+
+func updateQueueStats(update func(stats *QueueStats)) {
+	queueStatsLock.Lock()
+	defer queueStatsLock.Unlock()
+	update(&queueStats)
+}
+
+// Function to count a message rejected for the given reason, in the metrics and in the SQS polling counters.
+func countRejected(reason string) {
+	countRejected(reason)
+}
+
+// Function to count a message released back to SQS for the given reason.
+func countReleased(reason string) {
+	countReleased(reason)
+}
+
+// Function to get the SQS polling counters.
+func CurrentQueueStats() QueueStats {
+	queueStatsLock.Lock()
+	defer queueStatsLock.Unlock()
+	return queueStats
+}
 
 func init() {
 	// Agent id and signature are mandatory attributes in every SQS message that agent processes.
 	agentIdAttr := "agentId"
 	signatureAttr := "signature"
-	requiredAttributes = append(requiredAttributes, &agentIdAttr)
-	requiredAttributes = append(requiredAttributes, &signatureAttr)
+	messageAttributeNames = append(messageAttributeNames, &agentIdAttr)
+	messageAttributeNames = append(messageAttributeNames, &signatureAttr)
+
+	// Trace context is optional, and is joined if Neptune.io sends it.
+	traceparentAttr := traceparentAttribute
+	messageAttributeNames = append(messageAttributeNames, &traceparentAttr)
 }
 
 // Function to change SQS message visibility.
@@ -62,6 +110,11 @@ func changeMessageVisibility(svc *sqs.SQS, queue, receiptHandle string, timeout
 
 // Function to delete SQS message after the processing is done.
 func DeleteMessage(regInfo *RegistrationInfo, receiptHandle *string) error {
+	// Nothing to delete for retries, whose message was deleted by the first attempt.
+	if receiptHandle == nil || len(*receiptHandle) == 0 {
+		return nil
+	}
+
 	svc := getSQSClient(regInfo)
 
 	logging.Debug("Deleting the event from SQS.", nil)
@@ -81,6 +134,20 @@ func DeleteMessage(regInfo *RegistrationInfo, receiptHandle *string) error {
 	return nil
 }
 
+// Function to release an SQS message back to the queue so that it's received again after the given delay.
+func ReleaseMessage(regInfo *RegistrationInfo, receiptHandle *string, delay time.Duration) error {
+	logging.Debug("Releasing the event to SQS.", logging.Fields{"delay": delay})
+	return SetMessageVisibility(regInfo, receiptHandle, delay)
+}
+
+// Function to hide an SQS message from the queue for the given duration from now.
+func SetMessageVisibility(regInfo *RegistrationInfo, receiptHandle *string, timeout time.Duration) error {
+	if receiptHandle == nil || len(*receiptHandle) == 0 {
+		return nil
+	}
+	return changeMessageVisibility(getSQSClient(regInfo), regInfo.ActionQueueEndpoint, *receiptHandle, int64(timeout/time.Second))
+}
+
 func parseQueueDetails(queueUrl string) (queue, region string) {
 	result := queueURLRegex.FindStringSubmatch(queueUrl)
 	return queueUrl, result[1]
@@ -93,7 +160,7 @@ func getMessages(svc *sqs.SQS, queue string) (*sqs.ReceiveMessageOutput, error)
 		MaxNumberOfMessages:   aws.Int64(maxNumMessagesToFetch),
 		VisibilityTimeout:     aws.Int64(defaultVisibilityTimeout),
 		WaitTimeSeconds:       aws.Int64(longPollTimeSeconds),
-		MessageAttributeNames: requiredAttributes,
+		MessageAttributeNames: messageAttributeNames,
 	}
 	logging.Debug("Polling SQS queue for messages.", nil)
 	resp, err := svc.ReceiveMessage(params)
@@ -105,6 +172,21 @@ func getMessages(svc *sqs.SQS, queue string) (*sqs.ReceiveMessageOutput, error)
 	return resp, nil
 }
 
+// Function to get the trace context sent by Neptune.io in the message, if any. An invalid one is ignored
+// so that the message starts a new trace.
+func messageTraceContext(msg *sqs.Message) *spanContext {
+	attr, ok := msg.MessageAttributes[traceparentAttribute]
+	if !ok || attr.StringValue == nil {
+		return nil
+	}
+	ctx, ok := parseTraceparent(*attr.StringValue)
+	if !ok {
+		logging.Debug("Ignoring the invalid trace context of the message.", logging.Fields{"msgId": *msg.MessageId})
+		return nil
+	}
+	return ctx
+}
+
 func getSQSClient(regInfo *RegistrationInfo) *sqs.SQS {
 	creds := credentials.NewStaticCredentials(regInfo.AWSAccessKey, regInfo.AWSSecretAccessKey, regInfo.AWSSecurityToken)
 	_, region := parseQueueDetails(regInfo.ActionQueueEndpoint)
@@ -148,7 +230,27 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 
 		default:
 			t1 := time.Now()
-			if resp, err := getMessages(svc, queue); err == nil {
+			resp, err := getMessages(svc, queue)
+			sqsPolls.inc("")
+			if err == nil {
+				messagesReceived.add("", float64(len(resp.Messages)))
+			} else {
+				sqsPollFailures.inc("")
+			}
+			updateQueueStats(func(stats *QueueStats) {
+				stats.Polls++
+				stats.LastPollTime = t1.UnixNano() / 1000000
+				if err == nil {
+					stats.ConsecutiveFailures = 0
+					stats.LastSuccessTime = stats.LastPollTime
+					stats.MessagesReceived += int64(len(resp.Messages))
+				} else {
+					stats.PollFailures++
+					stats.ConsecutiveFailures++
+				}
+			})
+
+			if err == nil {
 				shouldLogError = true
 				numFailures = 0
 				UpdateStatus(QueuePollingSucceeded)
@@ -161,20 +263,35 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 					agentId, ok := msg.MessageAttributes["agentId"]
 					if !ok {
 						logging.Error("Received message does not have agentId attribute.", logging.Fields{"msgId": messageId})
+						countRejected(rejectedMissingAttribute)
 						continue
 					}
 
 					if regInfo.AgentId == *agentId.StringValue {
 						logging.Debug("Received a message for me. Checking message integrity.", nil)
+						// The parent of the span comes with the message, so it starts when the receive did.
+						receive := startSpanAt("sqs.receive", spanKindConsumer, messageTraceContext(msg), t1)
+						receive.setAttribute("messaging.message_id", messageId)
 
 						signature, ok := msg.MessageAttributes["signature"]
 
 						if !ok {
 							logging.Error("Received message does not have signature attribute.", logging.Fields{"msgId": messageId})
+							countRejected(rejectedMissingAttribute)
+							receive.setError(errors.New("Message does not have signature attribute."))
+							receive.finish()
 							continue
 						}
 
-						if valid, err := VerifyMessage(bodyStr, *signature.StringValue); valid && err == nil {
+						verify := startSpan("VerifyMessage", spanKindInternal, receive.context())
+						valid, err := VerifyMessage(bodyStr, *signature.StringValue)
+						if err == nil && !valid {
+							verify.setError(errors.New("Message signature does not match."))
+						}
+						verify.setError(err)
+						verify.finish()
+
+						if valid && err == nil {
 							var event Event
 							err = json.Unmarshal([]byte(bodyStr), &event)
 							if err != nil {
@@ -182,6 +299,8 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 							} else {
 								event.SQSMessageId = messageId
 								event.ReceiptHandle = *msg.ReceiptHandle
+								event.trace = receive.context()
+								receive.setAttribute("neptune.event_id", event.EventId)
 							}
 
 							// Now that the message signature is verified, recheck the agent id from the message payload.
@@ -197,6 +316,7 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 								logging.Debug("Pushing the message for processing", logging.Fields{"eventId": event.EventId})
 								eventsChannel <- &event
 								shouldSleep = false
+								updateQueueStats(func(stats *QueueStats) { stats.MessagesAccepted++ })
 							} else {
 								// This means something is wrong. Ideally the agent id in message attribute and
 								// message payload should always match but otherwise, it's an issue.
@@ -205,15 +325,21 @@ func RunLoop(regInfo *RegistrationInfo, regInfoUpdatesCh <-chan string, eventsCh
 									"agent id in event does not match. Deleting the message.",
 									logging.Fields{"msgId": messageId})
 								DeleteMessage(regInfo, msg.ReceiptHandle)
+								countRejected(rejectedAgentIdMismatch)
+								receive.setError(errors.New("Agent id in the event does not match."))
 							}
 						} else {
 							logging.Error("Could not verify the message with signature so deleting the message.",
 								logging.Fields{"msgId": messageId, "error": err})
 							DeleteMessage(regInfo, msg.ReceiptHandle)
+							countRejected(rejectedSignature)
+							receive.setError(errors.New("Could not verify the message signature."))
 						}
+						receive.finish()
 					} else {
 						logging.Debug("Releasing a message which is not for me.", logging.Fields{"msgId": messageId})
 						changeMessageVisibility(svc, queue, *msg.ReceiptHandle, int64(0))
+						countReleased(releasedOtherAgent)
 					}
 				}
 			} else if shouldLogError {
@@ -0,0 +1,286 @@
+// Package tracing is responsible for tracing the handling of every event, from the SQS receive through
+// the message verification, the runbook fetch and execution, to reporting the result. Spans are batched
+// and exported in the OTLP/HTTP JSON format to a configured collector. The trace context follows the W3C
+// trace context format. It is taken from the traceparent attribute of the SQS message, if Neptune.io
+// sends one, and passed on to the runbook process in the TRACEPARENT environment variable.
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	// SQS message attribute and environment variable carrying the trace context.
+	traceparentAttribute = "traceparent"
+	traceparentEnvVar    = "TRACEPARENT"
+
+	// Span kinds and status codes as defined by OTLP.
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanKindConsumer = 5
+	spanStatusOk     = 1
+	spanStatusError  = 2
+
+	defaultTracingEndpoint      = "http://127.0.0.1:4318/v1/traces"
+	defaultTracingServiceName   = "neptune-agent"
+	defaultTracingFlushSeconds  = 5
+	maxSpansPerExport           = 512
+	maxQueuedSpans              = 4096
+	tracingExportTimeout        = 10 * time.Second
+	traceparentVersion          = "00"
+	traceparentSampledFlags     = 0x01
+	tracingInstrumentationScope = "github.com/neptuneio/agent"
+)
+
+// Identity of a span, which its children and the runbook process refer to.
+type spanContext struct {
+	traceId [16]byte
+	spanId  [8]byte
+	flags   byte
+}
+
+// Span of a traced operation. A nil span is a no-op, which is what tracing hands out when it's disabled.
+type span struct {
+	ctx        spanContext
+	parentId   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+// Global variables to hold the tracing settings and the spans waiting to be exported.
+var tracingConfig TracingConfig
+var queuedSpans chan *span
+
+// Function to initialize tracing from agent config and start exporting the spans.
+func InitializeTracing(config TracingConfig) {
+	if !config.Enabled {
+		return
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = defaultTracingEndpoint
+	}
+	if len(config.ServiceName) == 0 {
+		config.ServiceName = defaultTracingServiceName
+	}
+	if config.FlushIntervalSeconds <= 0 {
+		config.FlushIntervalSeconds = defaultTracingFlushSeconds
+	}
+	tracingConfig = config
+	queuedSpans = make(chan *span, maxQueuedSpans)
+
+	go exportSpans(queuedSpans, time.Duration(config.FlushIntervalSeconds)*time.Second)
+	logging.Info("Initialized tracing.", logging.Fields{"endpoint": config.Endpoint, "service": config.ServiceName})
+}
+
+// Function to parse a W3C traceparent header like "00-<trace id>-<span id>-01".
+func parseTraceparent(value string) (*spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 ||
+		len(parts[3]) != 2 {
+		return nil, false
+	}
+
+	ctx := &spanContext{}
+	if _, err := hex.Decode(ctx.traceId[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(ctx.spanId[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	flags := [1]byte{}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return nil, false
+	}
+	ctx.flags = flags[0]
+	if ctx.traceId == [16]byte{} || ctx.spanId == [8]byte{} {
+		return nil, false
+	}
+	return ctx, true
+}
+
+func (c *spanContext) traceparent() string {
+	return strings.Join([]string{traceparentVersion, hex.EncodeToString(c.traceId[:]),
+		hex.EncodeToString(c.spanId[:]), hex.EncodeToString([]byte{c.flags})}, "-")
+}
+
+// Function to start a span under the given parent, or in a new trace if there is no parent. Returns nil
+// if tracing is disabled.
+func startSpan(name string, kind int, parent *spanContext) *span {
+	return startSpanAt(name, kind, parent, time.Now())
+}
+
+// Function to start a span at the given time, for operations whose parent is only known once they are
+// done. The span keeps the trace flags of its parent, and new traces are sampled.
+func startSpanAt(name string, kind int, parent *spanContext, start time.Time) *span {
+	if queuedSpans == nil {
+		return nil
+	}
+
+	s := &span{name: name, kind: kind, start: start, attributes: map[string]string{}}
+	if parent != nil {
+		s.ctx.traceId = parent.traceId
+		s.ctx.flags = parent.flags
+		s.parentId = parent.spanId
+	} else {
+		rand.Read(s.ctx.traceId[:])
+		s.ctx.flags = traceparentSampledFlags
+	}
+	rand.Read(s.ctx.spanId[:])
+	return s
+}
+
+// Function to get the context of the span for its children. Returns nil for a nil span.
+func (s *span) context() *spanContext {
+	if s == nil {
+		return nil
+	}
+	ctx := s.ctx
+	return &ctx
+}
+
+func (s *span) setAttribute(key, value string) {
+	if s != nil && len(value) > 0 {
+		s.attributes[key] = value
+	}
+}
+
+// Function to mark the span as failed with the given error, if any.
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// Function to end the span and queue it for export. Spans of traces which the sender didn't sample are
+// not exported, though their context is still passed on. Spans are dropped if the queue is full, which
+// only happens if the collector is down for long.
+func (s *span) finish() {
+	if s == nil || s.ctx.flags&traceparentSampledFlags == 0 {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case queuedSpans <- s:
+	default:
+		logging.Debug("Dropping the span since the export queue is full.", logging.Fields{"span": s.name})
+	}
+}
+
+// Function to add the trace context of the given span to the environment of the runbook process, so
+// that the runbook can add its own spans to the trace.
+func addTraceEnv(env map[string]string, s *span) {
+	if s == nil {
+		delete(env, traceparentEnvVar)
+		return
+	}
+	env[traceparentEnvVar] = s.ctx.traceparent()
+}
+
+// Function to export the queued spans in batches, whenever a batch fills up or the interval passes.
+func exportSpans(spans <-chan *span, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	batch := []*span{}
+	for {
+		select {
+		case s := <-spans:
+			batch = append(batch, s)
+			if len(batch) < maxSpansPerExport {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := postSpans(batch); err != nil {
+			logging.Warn("Could not export the spans.", logging.Fields{"error": err, "count": len(batch)})
+		}
+		batch = []*span{}
+	}
+}
+
+// Function to post the spans to the collector as an OTLP/HTTP JSON request.
+func postSpans(spans []*span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: tracingExportTimeout}
+	resp, err := client.Post(tracingConfig.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Collector returned unexpected status: " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// Function to build the OTLP export request for the given spans. Ids are hex encoded and times are
+// nanoseconds since epoch, as per the OTLP JSON mapping.
+func otlpRequest(spans []*span) map[string]interface{} {
+	host := hostname
+	if md != nil {
+		host = md.HostName
+	}
+	resource := map[string]string{"service.name": tracingConfig.ServiceName, "service.version": AgentVersion, "host.name": host}
+	if regInfo != nil {
+		resource["neptune.agent_id"] = regInfo.AgentId
+	}
+
+	otlpSpans := []map[string]interface{}{}
+	for _, s := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.ctx.traceId[:]),
+			"spanId":            hex.EncodeToString(s.ctx.spanId[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]interface{}{"code": spanStatusOk},
+		}
+		if s.parentId != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentId[:])
+		}
+		if len(s.err) > 0 {
+			otlpSpan["status"] = map[string]interface{}{"code": spanStatusError, "message": logging.Redact(s.err)}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": tracingInstrumentationScope, "version": AgentVersion},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes map[string]string) []interface{} {
+	result := []interface{}{}
+	for k, v := range attributes {
+		result = append(result, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": v}})
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Test that valid traceparent headers are parsed and malformed ones are ignored.
+func TestParseTraceparent(t *testing.T) {
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const spanId = "00f067aa0ba902b7"
+
+	tests := []struct {
+		name      string
+		value     string
+		wantOk    bool
+		wantFlags byte
+	}{
+		{name: "sampled", value: "00-" + traceId + "-" + spanId + "-01", wantOk: true, wantFlags: 0x01},
+		{name: "not sampled", value: "00-" + traceId + "-" + spanId + "-00", wantOk: true, wantFlags: 0x00},
+		{name: "future version with more fields", value: "01-" + traceId + "-" + spanId + "-01-extra", wantOk: true, wantFlags: 0x01},
+		{name: "surrounding spaces", value: " 00-" + traceId + "-" + spanId + "-01 ", wantOk: true, wantFlags: 0x01},
+		{name: "empty", value: ""},
+		{name: "missing flags", value: "00-" + traceId + "-" + spanId},
+		{name: "invalid version", value: "ff-" + traceId + "-" + spanId + "-01"},
+		{name: "short trace id", value: "00-" + traceId[1:] + "-" + spanId + "-01"},
+		{name: "short span id", value: "00-" + traceId + "-" + spanId[1:] + "-01"},
+		{name: "not hex", value: "00-" + traceId + "-" + "zzf067aa0ba902b7" + "-01"},
+		{name: "all-zero trace id", value: "00-00000000000000000000000000000000-" + spanId + "-01"},
+		{name: "all-zero span id", value: "00-" + traceId + "-0000000000000000-01"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, ok := parseTraceparent(test.value)
+			if ok != test.wantOk {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", test.value, ok, test.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if hex.EncodeToString(ctx.traceId[:]) != traceId || hex.EncodeToString(ctx.spanId[:]) != spanId ||
+				ctx.flags != test.wantFlags {
+				t.Errorf("parseTraceparent(%q) = %+v", test.value, ctx)
+			}
+		})
+	}
+}
+
+// Test that the trace context passed on is the one parsed.
+func TestTraceparentRoundTrip(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, ok := parseTraceparent(value)
+	if !ok {
+		t.Fatalf("parseTraceparent(%q) failed", value)
+	}
+	if got := ctx.traceparent(); got != value {
+		t.Errorf("traceparent() = %q, want %q", got, value)
+	}
+}
@@ -0,0 +1,174 @@
+// Package transcript is responsible for recording the combined stdout and stderr of a runbook in
+// the order the lines were written. Every line is tagged with its stream and the offset from the
+// start of the execution, which makes it possible to reconstruct what happened when. The transcript
+// is written in full to the execution record, while only its head and tail are kept in memory for the
+// action output.
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+)
+
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+)
+
+// Combined transcript of the runbook output. At most the maximum output size is kept of each of the head
+// and the tail, which is all the action output can carry whatever the truncation strategy.
+type transcript struct {
+	sync.Mutex
+	start   time.Time
+	head    bytes.Buffer
+	tail    []byte
+	dropped int
+	file    *os.File
+	partial map[string][]byte
+}
+
+// Writer which copies the runbook output of one stream to the transcript.
+type transcriptWriter struct {
+	transcript *transcript
+	stream     string
+	w          io.Writer
+}
+
+// Function to start a new transcript for the given event. Lines are also written to the execution
+// record as they come so that the transcript survives an agent crash.
+func newTranscript(event *Event) *transcript {
+	t := &transcript{start: time.Now(), partial: map[string][]byte{}}
+
+	dir := executionRecordDir(event)
+	if len(dir) == 0 {
+		logging.Warn("Not writing the transcript file since execution records are not available.", logging.Fields{"eventId": event.EventId})
+		return t
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logging.Warn("Could not create execution record directory.", logging.Fields{"error": err, "dir": dir})
+		return t
+	}
+
+	path := filepath.Join(dir, executionTranscriptFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		logging.Warn("Could not create transcript file.", logging.Fields{"error": err, "file": path})
+		return t
+	}
+	t.file = f
+	return t
+}
+
+// Function to get the id which identifies an execution on this agent. Inflight action id is used when
+// present since that's what Neptune.io knows the execution by.
+func executionId(event *Event) string {
+	if len(event.InflightActionId) > 0 {
+		return event.InflightActionId
+	}
+	return event.EventId
+}
+
+// Function to wrap the given writer so that everything written to it is also added to the transcript.
+func (t *transcript) writer(stream string, w io.Writer) io.Writer {
+	return &transcriptWriter{transcript: t, stream: stream, w: w}
+}
+
+func (w *transcriptWriter) Write(p []byte) (int, error) {
+	w.transcript.add(w.stream, p)
+	return w.w.Write(p)
+}
+
+// Function to add the output of a stream to the transcript. Only complete lines are recorded and the
+// rest is kept until the stream writes the end of the line.
+func (t *transcript) add(stream string, p []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	data := append(t.partial[stream], p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.writeLine(stream, data[:i])
+		data = data[i+1:]
+	}
+	t.partial[stream] = append([]byte(nil), data...)
+}
+
+func (t *transcript) writeLine(stream string, line []byte) {
+	offset := time.Since(t.start).Seconds()
+	entry := fmt.Sprintf("+%.3fs [%s] %s\n", offset, stream, bytes.TrimRight(line, "\r"))
+
+	t.keep(entry)
+	if t.file != nil {
+		t.file.WriteString(logging.Redact(entry))
+	}
+}
+
+// Function to keep the entry in memory if it belongs to the head or the tail of the transcript. The tail
+// is only trimmed once it's twice the limit so that every line doesn't move the whole tail.
+func (t *transcript) keep(entry string) {
+	limit := maxOutputSize()
+	if room := limit - t.head.Len(); room > 0 && len(t.tail) == 0 {
+		n := len(entry)
+		if n > room {
+			n = headCut([]byte(entry), room, true)
+		}
+		t.head.WriteString(entry[:n])
+		entry = entry[n:]
+	}
+
+	t.tail = append(t.tail, entry...)
+	if len(t.tail) > 2*limit {
+		t.trimTail(limit)
+	}
+}
+
+func (t *transcript) trimTail(limit int) {
+	if len(t.tail) <= limit {
+		return
+	}
+	cut := tailCut(t.tail, len(t.tail)-limit, true)
+	t.dropped += cut
+	t.tail = append([]byte(nil), t.tail[cut:]...)
+}
+
+// Function to record the unfinished lines and close the transcript. Returns the complete transcript.
+func (t *transcript) finish() string {
+	t.Lock()
+	defer t.Unlock()
+
+	streams := []string{}
+	for stream := range t.partial {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	for _, stream := range streams {
+		if len(t.partial[stream]) > 0 {
+			t.writeLine(stream, t.partial[stream])
+			t.partial[stream] = nil
+		}
+	}
+
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+
+	t.trimTail(maxOutputSize())
+	result := t.head.String()
+	if t.dropped > 0 {
+		result += truncationMarker(t.dropped)
+	}
+	return result + string(t.tail)
+}
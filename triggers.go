@@ -0,0 +1,417 @@
+// Package triggers is responsible for the local triggers which let the agent react to events on its own
+// host, without waiting for Neptune.io. A trigger watches a log file for a pattern, a path for changes,
+// or checks that a process or a port is alive. When it fires, it either runs its runbook locally through
+// the same ExecuteAction pipeline as the events from Neptune.io, or sends an event to Neptune.io.
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neptuneio/agent/logging"
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+const (
+	// Trigger types.
+	logTrigger     = "log"
+	pathTrigger    = "path"
+	processTrigger = "process"
+	portTrigger    = "port"
+
+	// Trigger actions. A trigger runs its runbook locally unless it's set to send an event to Neptune.io.
+	runTriggerAction     = "run"
+	neptuneTriggerAction = "neptune"
+
+	// Prefix of the rule ids of local triggers, which don't exist in Neptune.io.
+	triggerRulePrefix = "trigger:"
+
+	defaultFileTriggerIntervalMs  = 500
+	defaultProbeTriggerIntervalMs = 5000
+	defaultTriggerCooldownSeconds = 60
+	portTriggerDialTimeout        = 3 * time.Second
+
+	// Environment variables telling the runbook what fired the trigger.
+	triggerNameEnvVar   = "NEPTUNE_TRIGGER_NAME"
+	triggerTypeEnvVar   = "NEPTUNE_TRIGGER_TYPE"
+	triggerDetailEnvVar = "NEPTUNE_TRIGGER_DETAIL"
+	triggerLineEnvVar   = "NEPTUNE_TRIGGER_LINE"
+)
+
+// Local trigger from the agent config. Depending on the type, the trigger watches Path for lines matching
+// Pattern (log) or for changes (path), or checks that Process is running (process) or that Address
+// accepts connections (port). A trigger fires at most once per cooldown.
+type LocalTrigger struct {
+	Name            string
+	Type            string
+	Path            string
+	Pattern         string
+	Process         string
+	Address         string
+	IntervalMs      int
+	CooldownSeconds int
+	Action          string
+	Runbook         RunbookRef
+	Environment     map[string]string
+}
+
+// Message sent to Neptune.io service when a trigger with the "neptune" action fires.
+type TriggerEventRequest struct {
+	AgentId     string
+	Hostname    string
+	TriggerName string
+	TriggerType string
+	Detail      string
+	Timestamp   int64
+}
+
+// State of a running trigger.
+type triggerWatcher struct {
+	trigger       LocalTrigger
+	pattern       *regexp.Regexp
+	lastFired     time.Time
+	regInfo       *RegistrationInfo
+	actionOutputs chan<- *ActionOutputMessage
+	githubKey     string
+
+	// State of the log file being tailed.
+	file    *os.File
+	offset  int64
+	partial string
+
+	// Last seen state of the watched path.
+	snapshot map[string]string
+}
+
+// Function to start the local triggers from the agent config. Invalid triggers are skipped.
+func StartTriggers(config TriggersConfig, regInfo *RegistrationInfo, actionOutputs chan<- *ActionOutputMessage, githubKey string) {
+	numStarted := 0
+	for _, trigger := range config.Watchers {
+		w, err := newTriggerWatcher(trigger)
+		if err != nil {
+			logging.Warn("Ignoring invalid local trigger.", logging.Fields{"trigger": trigger.Name, "error": err})
+			continue
+		}
+		w.regInfo, w.actionOutputs, w.githubKey = regInfo, actionOutputs, githubKey
+		go w.run()
+		numStarted++
+	}
+	if numStarted > 0 {
+		logging.Info("Started the local triggers.", logging.Fields{"count": numStarted})
+	}
+}
+
+// Function to validate the given trigger and fill in its defaults.
+func newTriggerWatcher(trigger LocalTrigger) (*triggerWatcher, error) {
+	if len(trigger.Name) == 0 {
+		return nil, errors.New("Trigger without name.")
+	}
+
+	w := &triggerWatcher{trigger: trigger}
+	interval := defaultProbeTriggerIntervalMs
+	switch trigger.Type {
+	case logTrigger:
+		if len(trigger.Path) == 0 || len(trigger.Pattern) == 0 {
+			return nil, errors.New("Log trigger must have a path and a pattern.")
+		}
+		pattern, err := regexp.Compile(trigger.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern. %v", err)
+		}
+		w.pattern = pattern
+		interval = defaultFileTriggerIntervalMs
+	case pathTrigger:
+		if len(trigger.Path) == 0 {
+			return nil, errors.New("Path trigger must have a path.")
+		}
+		interval = defaultFileTriggerIntervalMs
+	case processTrigger:
+		if len(trigger.Process) == 0 {
+			return nil, errors.New("Process trigger must have a process.")
+		}
+	case portTrigger:
+		if _, _, err := net.SplitHostPort(trigger.Address); err != nil {
+			return nil, fmt.Errorf("Invalid address. %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown trigger type %q.", trigger.Type)
+	}
+
+	switch trigger.Action {
+	case "":
+		w.trigger.Action = runTriggerAction
+		fallthrough
+	case runTriggerAction:
+		if err := trigger.Runbook.validate(); err != nil {
+			return nil, err
+		}
+	case neptuneTriggerAction:
+	default:
+		return nil, fmt.Errorf("Unknown trigger action %q.", trigger.Action)
+	}
+
+	if w.trigger.IntervalMs <= 0 {
+		w.trigger.IntervalMs = interval
+	}
+	if w.trigger.CooldownSeconds <= 0 {
+		w.trigger.CooldownSeconds = defaultTriggerCooldownSeconds
+	}
+	return w, nil
+}
+
+func (w *triggerWatcher) run() {
+	switch w.trigger.Type {
+	case logTrigger:
+		w.openLog(true)
+	case pathTrigger:
+		w.snapshot = pathSnapshot(w.trigger.Path)
+	}
+
+	for {
+		time.Sleep(time.Duration(w.trigger.IntervalMs) * time.Millisecond)
+		switch w.trigger.Type {
+		case logTrigger:
+			w.pollLog()
+		case pathTrigger:
+			w.pollPath()
+		case processTrigger:
+			w.pollProcess()
+		case portTrigger:
+			w.pollPort()
+		}
+	}
+}
+
+// Function to open the watched log file. The file is read from its end when the trigger starts, so that
+// old lines don't fire it, and from its start after a rotation.
+func (w *triggerWatcher) openLog(atEnd bool) {
+	f, err := os.Open(w.trigger.Path)
+	if err != nil {
+		return
+	}
+
+	w.offset = 0
+	if atEnd {
+		if w.offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return
+		}
+	}
+	w.file = f
+	w.partial = ""
+}
+
+// Function to read the new lines of the watched log file. Lines still in the old file are read before
+// following a rotation, and a truncated file is read again from its start.
+func (w *triggerWatcher) pollLog() {
+	if w.file == nil {
+		w.openLog(false)
+		if w.file == nil {
+			return
+		}
+	}
+	w.readLog()
+
+	current, err := w.file.Stat()
+	if err != nil {
+		w.closeLog()
+		return
+	}
+	latest, err := os.Stat(w.trigger.Path)
+	if err != nil {
+		// The file was moved away and its replacement isn't there yet.
+		return
+	}
+
+	if !os.SameFile(current, latest) {
+		logging.Debug("Following the rotated log file.", logging.Fields{"trigger": w.trigger.Name, "file": w.trigger.Path})
+		w.closeLog()
+		w.openLog(false)
+		w.readLog()
+	} else if latest.Size() < w.offset {
+		logging.Debug("Reading the truncated log file again.", logging.Fields{"trigger": w.trigger.Name, "file": w.trigger.Path})
+		if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+			w.closeLog()
+			return
+		}
+		w.offset = 0
+		w.partial = ""
+		w.readLog()
+	}
+}
+
+func (w *triggerWatcher) readLog() {
+	if w.file == nil {
+		return
+	}
+
+	reader := bufio.NewReader(w.file)
+	for {
+		line, err := reader.ReadString('\n')
+		w.offset += int64(len(line))
+		if err != nil {
+			// Keep the incomplete last line until the rest of it is written.
+			w.partial += line
+			return
+		}
+
+		line = strings.TrimRight(w.partial+line, "\r\n")
+		w.partial = ""
+		if w.pattern.MatchString(line) {
+			w.fire("Log line matched the pattern.", map[string]string{triggerLineEnvVar: line})
+		}
+	}
+}
+
+func (w *triggerWatcher) closeLog() {
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = nil
+	w.offset = 0
+	w.partial = ""
+}
+
+// Function to get the modification time and size of the given path, and of its entries if it's a directory.
+func pathSnapshot(path string) map[string]string {
+	snapshot := map[string]string{}
+	info, err := os.Stat(path)
+	if err != nil {
+		return snapshot
+	}
+	snapshot[path] = fileState(info)
+
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return snapshot
+		}
+		for _, entry := range entries {
+			snapshot[filepath.Join(path, entry.Name())] = fileState(entry)
+		}
+	}
+	return snapshot
+}
+
+func fileState(info os.FileInfo) string {
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "/" + strconv.FormatInt(info.Size(), 10)
+}
+
+func (w *triggerWatcher) pollPath() {
+	snapshot := pathSnapshot(w.trigger.Path)
+	changed := []string{}
+	for path, state := range snapshot {
+		if w.snapshot[path] != state {
+			changed = append(changed, path)
+		}
+	}
+	for path := range w.snapshot {
+		if _, ok := snapshot[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	w.snapshot = snapshot
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		w.fire("Changed: "+strings.Join(changed, ", "), nil)
+	}
+}
+
+func (w *triggerWatcher) pollProcess() {
+	running, err := isProcessRunning(w.trigger.Process)
+	if err != nil {
+		logging.Warn("Could not check if the process is running.", logging.Fields{"trigger": w.trigger.Name, "error": err})
+		return
+	}
+	if !running {
+		w.fire("Process "+w.trigger.Process+" is not running.", nil)
+	}
+}
+
+func (w *triggerWatcher) pollPort() {
+	conn, err := net.DialTimeout("tcp", w.trigger.Address, portTriggerDialTimeout)
+	if err != nil {
+		w.fire(fmt.Sprintf("Could not connect to %s. %v", w.trigger.Address, err), nil)
+		return
+	}
+	conn.Close()
+}
+
+// Function to fire the trigger unless it fired within its cooldown.
+func (w *triggerWatcher) fire(detail string, extraEnv map[string]string) {
+	if time.Since(w.lastFired) < time.Duration(w.trigger.CooldownSeconds)*time.Second {
+		logging.Debug("Not firing the trigger during its cooldown.", logging.Fields{"trigger": w.trigger.Name, "detail": detail})
+		return
+	}
+	w.lastFired = time.Now()
+	logging.Info("Local trigger fired.", logging.Fields{"trigger": w.trigger.Name, "type": w.trigger.Type, "detail": detail})
+
+	if w.trigger.Action == neptuneTriggerAction {
+		go func() {
+			if err := sendTriggerEvent(w.trigger, detail); err != nil {
+				logging.Error("Could not send the trigger event.", logging.Fields{"trigger": w.trigger.Name, "error": err})
+			}
+		}()
+		return
+	}
+
+	env := map[string]string{}
+	for k, v := range w.trigger.Environment {
+		env[k] = v
+	}
+	for k, v := range extraEnv {
+		env[k] = v
+	}
+	env[triggerNameEnvVar] = w.trigger.Name
+	env[triggerTypeEnvVar] = w.trigger.Type
+	env[triggerDetailEnvVar] = detail
+
+	event := localEvent(triggerRulePrefix, w.trigger.Name, w.trigger.Runbook, env)
+	go func() {
+		if err := ExecuteAction(event, w.regInfo, w.actionOutputs, w.githubKey); err != nil {
+			logging.Error("Could not run the runbook of the trigger.", logging.Fields{"trigger": w.trigger.Name, "error": err})
+		}
+	}()
+}
+
+// Function to send an event for the fired trigger to Neptune.io, where rules can act on it.
+func sendTriggerEvent(trigger LocalTrigger, detail string) error {
+	if neptuneConfig == nil {
+		return errors.New("Neptune.io endpoint is not configured.")
+	}
+
+	request := TriggerEventRequest{
+		Hostname:    hostname,
+		TriggerName: trigger.Name,
+		TriggerType: trigger.Type,
+		Detail:      detail,
+		Timestamp:   time.Now().UnixNano() / 1000000,
+	}
+	if md != nil {
+		request.Hostname = md.HostName
+	}
+	if regInfo != nil {
+		request.AgentId = regInfo.AgentId
+	}
+
+	resp, err := napping.Post(joinURL(neptuneConfig.Endpoint, "agent_events", neptuneConfig.ApiKey), &request, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Status() < 200 || resp.Status() > 299 {
+		return errors.New("Server returned unexpected status: " + strconv.Itoa(resp.Status()))
+	}
+	return nil
+}
@@ -75,7 +75,7 @@ func UploadLogs(configObj *NeptuneConfig, filename string, agentId string) error
 	if offset < 0 {
 		offset = 0
 	}
-	logContent := strings.Join(lines[offset:], "\n")
+	logContent := logging.Redact(strings.Join(lines[offset:], "\n"))
 
 	logging.Debug("Uploading logs to Neptune.", nil)
 	request := UploadLogsRequest{AgentId: agentId, FullLogs: true, ErrorMessage: logContent}
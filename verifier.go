@@ -26,21 +26,23 @@ const (
 // Global variable to hold Neptune.io's public key.
 var publicKey *rsa.PublicKey
 
-func init() {
+// Function to load Neptune.io's public key from the certificate file next to the agent binary. The
+// agent can't verify any message without it, so MainLoop exits if it fails. It's not loaded from init
+// since the package is also loaded by test binaries and the local tooling commands, which have no
+// certificate next to them.
+func InitializePublicKey() error {
 	// Get the full path of the binary and pick the certificate file from the same directory.
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err == nil {
-		certFilePath := filepath.Join(dir, certificateFileName)
-		key, e := loadPublicKey(certFilePath)
-		if e == nil {
-			publicKey = key
-		}
+	if err != nil {
+		return err
 	}
 
-	if publicKey == nil {
-		fmt.Println("Could not load public key.")
-		os.Exit(1)
+	key, err := loadPublicKey(filepath.Join(dir, certificateFileName))
+	if err != nil {
+		return err
 	}
+	publicKey = key
+	return nil
 }
 
 // Function to load Neptune.io's public key while booting up the agent. This public key will be used